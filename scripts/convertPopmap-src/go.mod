@@ -1,15 +0,0 @@
-module github.com/mappichat/regions-engine/scripts/convertPopmap-src
-
-go 1.18
-
-require (
-	github.com/mappichat/regions-engine v0.0.0-20220816014922-e8a81a7dba09
-	github.com/uber/h3-go/v3 v3.7.1
-)
-
-require (
-	github.com/MicahParks/keyfunc v1.2.0 // indirect
-	github.com/golang-jwt/jwt/v4 v4.4.2 // indirect
-	github.com/iancoleman/strcase v0.2.0 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
-)
@@ -10,6 +10,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
 )
 
 const maxInsert int = 65535
@@ -57,8 +58,8 @@ func CreateTables(db *sqlx.DB) error {
 
 func PopulateCountries(db *sqlx.DB, h3ToCountry *project_types.H3ToCountry) error {
 	values := []map[string]interface{}{}
-	for h3, country := range *h3ToCountry {
-		values = append(values, map[string]interface{}{"h3": h3, "country": strings.ToLower(country)})
+	for tile, country := range *h3ToCountry {
+		values = append(values, map[string]interface{}{"h3": h3.ToString(tile), "country": strings.ToLower(country)})
 	}
 	batchSize := maxInsert / 2
 	for i := 0; i < len(values); i += batchSize {
@@ -72,7 +73,7 @@ func PopulateCountries(db *sqlx.DB, h3ToCountry *project_types.H3ToCountry) erro
 	return nil
 }
 
-func PopulateTiles(db *sqlx.DB, levels []map[string]project_types.Region) error {
+func PopulateTiles(db *sqlx.DB, levels []project_types.Level) error {
 	wg := sync.WaitGroup{}
 	for i := range levels {
 		wg.Add(1)
@@ -85,13 +86,14 @@ func PopulateTiles(db *sqlx.DB, levels []map[string]project_types.Region) error
 	return nil
 }
 
-func PopulateTile(db *sqlx.DB, levelIndex int, level *map[string]project_types.Region) error {
+func PopulateTile(db *sqlx.DB, levelIndex int, level *project_types.Level) error {
 	batchSize := maxInsert / 3
 
 	values := []map[string]interface{}{}
-	for h3 := range *level {
-		for _, tile := range (*level)[h3].Tiles {
-			values = append(values, map[string]interface{}{"h3": tile, "region": h3, "level": levelIndex})
+	for _, region := range *level {
+		index := h3.ToString(region.Index)
+		for _, tile := range region.Tiles {
+			values = append(values, map[string]interface{}{"h3": h3.ToString(tile), "region": index, "level": levelIndex})
 		}
 	}
 	total := len(values)
@@ -108,7 +110,7 @@ func PopulateTile(db *sqlx.DB, levelIndex int, level *map[string]project_types.R
 	return nil
 }
 
-func PopulateNeighbors(db *sqlx.DB, levels []map[string]project_types.Region) error {
+func PopulateNeighbors(db *sqlx.DB, levels []project_types.Level) error {
 	wg := sync.WaitGroup{}
 	for i := range levels {
 		wg.Add(1)
@@ -129,12 +131,13 @@ func hashPair(h1 string, h2 string) string {
 	}
 }
 
-func PopulateNeighbor(db *sqlx.DB, levelIndex int, level *map[string]project_types.Region) error {
+func PopulateNeighbor(db *sqlx.DB, levelIndex int, level *project_types.Level) error {
 	batchSize := maxInsert / 3
 	values := []map[string]interface{}{}
-	for h3 := range *level {
-		for neighbor := range (*level)[h3].Neighbors {
-			values = append(values, map[string]interface{}{"region": h3, "neighbor": neighbor, "level": levelIndex})
+	for _, region := range *level {
+		index := h3.ToString(region.Index)
+		for _, neighbor := range region.Neighbors {
+			values = append(values, map[string]interface{}{"region": index, "neighbor": h3.ToString((*level)[neighbor].Index), "level": levelIndex})
 		}
 	}
 	total := len(values)
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"github.com/mappichat/regions-engine/src/project_types"
+)
+
+const (
+	adminHard                   = "hard"
+	adminSoft                   = "soft"
+	defaultAdminCrossingPenalty = 4.0
+)
+
+// regionAdmins returns the admin-1 area most of each region's tiles are in,
+// or nil when options ignore admin-1 boundaries
+func regionAdmins(level project_types.Level, h3ToAdmin project_types.H3ToAdmin, options *project_types.LevelOptions) []string {
+	if options.AdminBoundary == "" || len(h3ToAdmin) == 0 {
+		return nil
+	}
+	admins := make([]string, len(level))
+	counts := map[string]int{}
+	for id, region := range level {
+		for admin := range counts {
+			delete(counts, admin)
+		}
+		for _, tile := range region.Tiles {
+			if admin, ok := h3ToAdmin[tile]; ok {
+				counts[admin]++
+			}
+		}
+		for admin, count := range counts {
+			if count > counts[admins[id]] || (count == counts[admins[id]] && admin < admins[id]) {
+				admins[id] = admin
+			}
+		}
+	}
+	return admins
+}
+
+// crossesAdmin reports whether a and b are in different admin-1 areas.
+// Tiles outside every area, like coast fill, belong to either side.
+func crossesAdmin(a string, b string) bool {
+	return a != "" && b != "" && a != b
+}
+
+// adminBlocks reports whether options forbid joining regions in areas a and b
+func adminBlocks(options *project_types.LevelOptions, a string, b string) bool {
+	return options.AdminBoundary == adminHard && crossesAdmin(a, b)
+}
+
+// adminPenalty is what the growth priority of a neighbor across an admin-1
+// boundary is divided by
+func adminPenalty(options *project_types.LevelOptions, a string, b string) float64 {
+	if options.AdminBoundary != adminSoft || !crossesAdmin(a, b) {
+		return 1
+	}
+	if options.AdminCrossingPenalty > 0 {
+		return options.AdminCrossingPenalty
+	}
+	return defaultAdminCrossingPenalty
+}
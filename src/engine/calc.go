@@ -11,208 +11,323 @@ import (
 	"sort"
 	"sync"
 
+	"github.com/mappichat/regions-engine/src/fileio"
 	"github.com/mappichat/regions-engine/src/project_types"
 	"github.com/mappichat/regions-engine/src/utils"
 	h3 "github.com/uber/h3-go/v3"
 )
 
-func GenerateLevel0(pop_map project_types.PopMap, tiles []string) (project_types.Level, error) {
-	level := make(map[string]project_types.Region, len(tiles))
-	tileSet := make(map[string]bool, len(tiles))
-	for j := range tiles {
-		tileSet[tiles[j]] = true
+// GenerateLevel0 makes a region of every tile. Regions carry the weights of
+// their tile in weightMaps, if there are any.
+func GenerateLevel0(pop_map project_types.PopMap, weightMaps project_types.WeightMaps, tiles []h3.H3Index) (project_types.Level, error) {
+	sorted := append([]h3.H3Index{}, tiles...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ids := make(map[h3.H3Index]project_types.RegionID, len(sorted))
+	unique := sorted[:0]
+	for _, tile := range sorted {
+		if _, ok := ids[tile]; !ok {
+			ids[tile] = project_types.RegionID(len(unique))
+			unique = append(unique, tile)
+		}
 	}
+	sorted = unique
 
-	i := 0
-	for _, tile := range tiles {
+	level := make(project_types.Level, len(sorted))
+	weights := tileWeights(weightMaps, sorted)
+	for i, tile := range sorted {
 		pop, ok := pop_map[tile]
 		if !ok {
-			return nil, errors.New(tile + " not found in pop map")
+			return nil, errors.New(h3.ToString(tile) + " not found in pop map")
 		}
 
 		newRegion := project_types.Region{
 			Index:      tile,
 			Population: pop,
-			Tiles:      []string{tile},
-			Neighbors:  map[string]bool{},
-			Centroid:   h3.ToGeo(h3.FromString(tile)),
-		}
-		for _, k := range h3.KRing(h3.FromString(tile), 1) {
-			h3String := h3.ToString(k)
-			if h3String != tile {
-				newRegion.Neighbors[h3String] = true
+			Tiles:      []h3.H3Index{tile},
+			Neighbors:  []project_types.RegionID{},
+			Centroid:   h3.ToGeo(tile),
+		}
+		if weights != nil {
+			newRegion.Weights = weights[i]
+		}
+		for _, k := range h3.KRing(tile, 1) {
+			if id, ok := ids[k]; ok && k != tile {
+				newRegion.Neighbors = append(newRegion.Neighbors, id)
 			}
 		}
-		level[tile] = newRegion
-		i++
-		if i%1000000 == 0 {
-			log.Print(i)
+		sort.Slice(newRegion.Neighbors, func(a, b int) bool { return newRegion.Neighbors[a] < newRegion.Neighbors[b] })
+		level[i] = newRegion
+		if (i+1)%1000000 == 0 {
+			log.Print(i + 1)
 		}
 	}
 
-	// give regions with zero neighbors a neighbor
-	sorted := []string{}
-	for tile := range level {
-		sorted = append(sorted, tile)
-	}
-	sort.Strings(sorted)
-	for tile := range level {
-		if len(level[tile].Neighbors) == 0 {
-			index := sort.SearchStrings(sorted, tile)
-			neighbor := sorted[(index+1)%len(sorted)]
-			level[tile].Neighbors[neighbor] = true
-			level[neighbor].Neighbors[tile] = true
-		}
+	return level, nil
+}
+
+// centroidSum averages tile centers. Longitudes are also summed shifted into
+// [0, 360), and whichever copy spans less is averaged, so regions across the
+// antimeridian get a centroid between their tiles instead of one on the far
+// side of the world.
+type centroidSum struct {
+	n                 int
+	lat, lng, shifted float64
+	lngs, shifteds    [2]float64 // min and max
+}
+
+func (c *centroidSum) add(coord h3.GeoCoord) {
+	shifted := coord.Longitude
+	if shifted < 0 {
+		shifted += 360
 	}
+	if c.n == 0 {
+		c.lngs = [2]float64{coord.Longitude, coord.Longitude}
+		c.shifteds = [2]float64{shifted, shifted}
+	}
+	c.n++
+	c.lat += coord.Latitude
+	c.lng += coord.Longitude
+	c.shifted += shifted
+	c.lngs = [2]float64{math.Min(c.lngs[0], coord.Longitude), math.Max(c.lngs[1], coord.Longitude)}
+	c.shifteds = [2]float64{math.Min(c.shifteds[0], shifted), math.Max(c.shifteds[1], shifted)}
+}
 
-	return level, nil
+func (c centroidSum) centroid() h3.GeoCoord {
+	n := float64(c.n)
+	if c.shifteds[1]-c.shifteds[0] < c.lngs[1]-c.lngs[0] {
+		lng := c.shifted / n
+		if lng > 180 {
+			lng -= 360
+		}
+		return h3.GeoCoord{Latitude: c.lat / n, Longitude: lng}
+	}
+	return h3.GeoCoord{Latitude: c.lat / n, Longitude: c.lng / n}
 }
 
-func calcCentroid(r *project_types.Region) h3.GeoCoord {
-	latSum := 0.0
-	lonSum := 0.0
-	size := len(r.Tiles)
-	for _, tile := range r.Tiles {
-		latSum += h3.ToGeo(h3.FromString(tile)).Latitude
-		lonSum += h3.ToGeo(h3.FromString(tile)).Longitude
+func calcCentroid(tiles []h3.H3Index) h3.GeoCoord {
+	sum := centroidSum{}
+	for _, tile := range tiles {
+		sum.add(h3.ToGeo(tile))
 	}
-	return h3.GeoCoord{Latitude: latSum / float64(size), Longitude: lonSum / float64(size)}
+	return sum.centroid()
 }
 
-func mergeRegions(level map[string]project_types.Region, parents map[string]string, into string, mergee string) {
-	intoRegion := level[into]
+// growingRegion is a region of the level being generated. Regions refer to
+// each other by their position in the slice they're built in.
+type growingRegion struct {
+	index      h3.H3Index
+	population float64
+	weights    project_types.Weights
+	tiles      []h3.H3Index
+	neighbors  map[int]bool
+	centroid   h3.GeoCoord
+	size       int // tiles counted against the size limits
+	merged     bool
+	mergedInto int
+	admin      string // admin-1 area, only set when options use admin-1 boundaries
+}
 
-	intoRegion.Population += level[mergee].Population
+func mergeRegions(level []growingRegion, into int, mergee int) {
+	level[into].population += level[mergee].population
+	level[into].size += level[mergee].size
+	level[into].weights = project_types.AddWeights(level[into].weights, level[mergee].weights)
+	level[into].tiles = append(level[into].tiles, level[mergee].tiles...)
 
-	for _, tile := range level[mergee].Tiles {
-		parents[tile] = intoRegion.Index
+	for neighbor := range level[mergee].neighbors {
+		level[into].neighbors[neighbor] = true
+		delete(level[neighbor].neighbors, mergee)
+		level[neighbor].neighbors[into] = true
 	}
-	intoRegion.Tiles = append(intoRegion.Tiles, level[mergee].Tiles...)
+	delete(level[into].neighbors, mergee)
+	delete(level[into].neighbors, into)
 
-	for neighbor := range level[mergee].Neighbors {
-		intoRegion.Neighbors[neighbor] = true
-		delete(level[neighbor].Neighbors, mergee)
-		level[neighbor].Neighbors[into] = true
-	}
-	delete(intoRegion.Neighbors, mergee)
-	delete(intoRegion.Neighbors, into)
+	level[into].centroid = calcCentroid(level[into].tiles)
 
-	intoRegion.Centroid = calcCentroid(&intoRegion)
+	level[mergee].merged = true
+	level[mergee].mergedInto = into
+	level[mergee].neighbors = nil
+	level[mergee].tiles = nil
+	level[mergee].weights = nil
+}
 
-	delete(level, mergee)
-	level[into] = intoRegion
+// remaining returns the regions that haven't been merged away, in visiting order
+func remaining(level []growingRegion, ordering Ordering) []int {
+	ids := []int{}
+	for id := range level {
+		if !level[id].merged {
+			ids = append(ids, id)
+		}
+	}
+	sortByIndex(ids, func(id int) h3.H3Index { return level[id].index }, ordering)
+	return ids
 }
 
-func GenerateLevel(prevLevel map[string]project_types.Region, options *project_types.LevelOptions) (map[string]project_types.Region, map[string]string) {
+// orderedNeighbors returns ids in visiting order
+func orderedNeighbors(neighbors map[int]bool, level []growingRegion, ordering Ordering) []int {
+	ids := make([]int, 0, len(neighbors))
+	for id := range neighbors {
+		ids = append(ids, id)
+	}
+	sortByIndex(ids, func(id int) h3.H3Index { return level[id].index }, ordering)
+	return ids
+}
+
+// GenerateLevel groups the regions of prevLevel into larger regions. It also
+// returns the regions that are still below options' minimums. h3ToAdmin is
+// only needed when options use admin-1 boundaries and ocean when they exclude
+// ocean tiles from region sizes.
+func GenerateLevel(prevLevel project_types.Level, options *project_types.LevelOptions, ordering Ordering, h3ToAdmin project_types.H3ToAdmin, ocean map[h3.H3Index]bool) (project_types.Level, []project_types.UnmetRegion) {
 	// initializations
-	queue := &project_types.LevelQueue{Length: 0, Regions: []project_types.Region{}}
-	for _, region := range prevLevel {
-		heap.Push(queue, region)
+	weighing := newWeighing(options)
+	prevSizes := regionSizes(prevLevel, ocean, options)
+	prevAdmins := regionAdmins(prevLevel, h3ToAdmin, options)
+	adminOf := func(id project_types.RegionID) string {
+		if prevAdmins == nil {
+			return ""
+		}
+		return prevAdmins[id]
 	}
-	parents := map[string]string{}
-	level := map[string]project_types.Region{}
+	queue := &project_types.LevelQueue{Length: 0, Items: []project_types.QueueItem{}}
+	prevIDs := make([]project_types.RegionID, len(prevLevel))
+	for i := range prevIDs {
+		prevIDs[i] = project_types.RegionID(i)
+	}
+	if ordering.Seed != 0 {
+		sortByIndex(prevIDs, func(id project_types.RegionID) h3.H3Index { return prevLevel[id].Index }, ordering)
+	}
+	for _, id := range prevIDs {
+		heap.Push(queue, project_types.QueueItem{Region: id, Priority: weighing.score(prevLevel[id].Population, prevLevel[id].Weights)})
+	}
+	parents := make([]int, len(prevLevel)) // prevLevel region -> position in level, -1 if unassigned
+	for i := range parents {
+		parents[i] = -1
+	}
+	level := []growingRegion{}
+	neighborBuffer := []project_types.RegionID{}
 
 	// main loop
 	for queue.Length > 0 {
-		next := heap.Pop(queue).(project_types.Region)
-		if _, in := parents[next.Index]; in {
+		next := heap.Pop(queue).(project_types.QueueItem)
+		if parents[next.Region] >= 0 {
 			continue
 		}
-		locQueue := &project_types.LevelQueue{Length: 0, Regions: []project_types.Region{}}
+		locQueue := &project_types.LevelQueue{Length: 0, Items: []project_types.QueueItem{}}
 		locQueue.Push(next)
-		region := project_types.Region{
-			Index:      next.Index,
-			Population: 0,
-			Tiles:      []string{},
-			Neighbors:  map[string]bool{},
-			Centroid:   h3.GeoCoord{Latitude: 0, Longitude: 0},
+		regionID := len(level)
+		region := growingRegion{
+			index:      prevLevel[next.Region].Index,
+			population: 0,
+			tiles:      []h3.H3Index{},
+			neighbors:  map[int]bool{},
+			centroid:   h3.GeoCoord{Latitude: 0, Longitude: 0},
 		}
 
 		// <- centroid this prevents readding on already seen tiles ->
-		latSum := 0.0
-		lonSum := 0.0
+		centroid := centroidSum{}
 		// <- ->
 
 		for locQueue.Length > 0 {
-			currentRegion := heap.Pop(locQueue).(project_types.Region)
+			current := heap.Pop(locQueue).(project_types.QueueItem).Region
+			currentRegion := &prevLevel[current]
 
 			// check against constraints
-			if _, in := parents[currentRegion.Index]; in {
+			if parents[current] >= 0 {
 				continue
 			}
-			if len(region.Tiles) > 0 { // constraints only apply if region is non empty
-				if prevLevel[currentRegion.Index].Population+region.Population > options.MaxPop {
+			if len(region.tiles) > 0 { // constraints only apply if region is non empty
+				if currentRegion.Population+region.population > options.MaxPop {
 					continue
 				}
-				if len(currentRegion.Tiles)+len(region.Tiles) > options.MaxRegionSize {
+				if prevSizes[current]+region.size > options.MaxRegionSize {
 					continue
 				}
+				if weighing.exceeds(region.weights, currentRegion.Weights) {
+					continue
+				}
+				if adminBlocks(options, region.admin, adminOf(current)) {
+					continue
+				}
+			}
+			if region.admin == "" {
+				region.admin = adminOf(current)
 			}
 
 			// Add to parent region
-			region.Tiles = append(region.Tiles, currentRegion.Tiles...)
+			region.tiles = append(region.tiles, currentRegion.Tiles...)
+			region.size += prevSizes[current]
+			parents[current] = regionID
 			for _, tile := range currentRegion.Tiles {
-				parents[tile] = region.Index
-				geo := h3.ToGeo(h3.FromString(tile))
-				latSum += geo.Latitude
-				lonSum += geo.Longitude
+				centroid.add(h3.ToGeo(tile))
 			}
-			region.Centroid = h3.GeoCoord{
-				Latitude:  latSum / float64(len(region.Tiles)),
-				Longitude: lonSum / float64(len(region.Tiles)),
+			region.centroid = centroid.centroid()
+			region.population += currentRegion.Population
+			region.weights = project_types.AddWeights(region.weights, currentRegion.Weights)
+
+			neighbors := currentRegion.Neighbors
+			if ordering.Seed != 0 {
+				neighborBuffer = append(neighborBuffer[:0], neighbors...)
+				sortByIndex(neighborBuffer, func(id project_types.RegionID) h3.H3Index { return prevLevel[id].Index }, ordering)
+				neighbors = neighborBuffer
 			}
-			region.Population += prevLevel[currentRegion.Index].Population
-
-			for neighbor := range currentRegion.Neighbors {
-				parent, in := parents[neighbor]
-				if !in {
+			for _, neighbor := range neighbors {
+				neighborRegion := &prevLevel[neighbor]
+				parent := parents[neighbor]
+				if parent < 0 {
 					// // check size to make sure it doesn't break constraint
-					if len(prevLevel[neighbor].Tiles)+len(region.Tiles) > options.MaxRegionSize {
+					if prevSizes[neighbor]+region.size > options.MaxRegionSize {
 						continue
 					}
 
 					// check population to make sure it doesn't break constraint
-					if prevLevel[neighbor].Population+region.Population > options.MaxPop {
+					if neighborRegion.Population+region.population > options.MaxPop {
+						continue
+					}
+
+					if weighing.exceeds(region.weights, neighborRegion.Weights) {
+						continue
+					}
+
+					if adminBlocks(options, region.admin, adminOf(neighbor)) {
 						continue
 					}
 
 					// <- centroid mult ->
-					latDiff := prevLevel[neighbor].Centroid.Latitude - region.Centroid.Latitude
-					lonDiff := prevLevel[neighbor].Centroid.Longitude - region.Centroid.Longitude
+					latDiff := neighborRegion.Centroid.Latitude - region.centroid.Latitude
+					lonDiff := utils.LngDelta(region.centroid.Longitude, neighborRegion.Centroid.Longitude)
 					dist := math.Sqrt((latDiff * latDiff) + (lonDiff * lonDiff))
 					// <- ->
 
-					weightedPop := prevLevel[neighbor].Population
+					weightedPop := weighing.score(neighborRegion.Population, neighborRegion.Weights)
 					if weightedPop == 0 {
 						weightedPop = 1.0
 					}
 					weightedPop *= math.Pow(dist, options.DistanceExponent)
+					weightedPop /= adminPenalty(options, region.admin, adminOf(neighbor))
 
-					heap.Push(locQueue, project_types.Region{
-						Index:      neighbor,
-						Population: weightedPop,
-						Tiles:      prevLevel[neighbor].Tiles,
-						Neighbors:  prevLevel[neighbor].Neighbors,
-						Centroid:   prevLevel[neighbor].Centroid,
-					})
-				} else if parent != region.Index {
-					region.Neighbors[parent] = true
-					level[parent].Neighbors[region.Index] = true
+					heap.Push(locQueue, project_types.QueueItem{Region: neighbor, Priority: weightedPop})
+				} else if parent != regionID {
+					region.neighbors[parent] = true
+					level[parent].neighbors[regionID] = true
 				}
 			}
 		}
-		level[region.Index] = region
+		level = append(level, region)
 	}
 
 	// remove islands
 	if len(level) == 1 { // entire level merged; return
-		return level, parents
+		return finishLevel(level), unmetRegions(level, options, ordering)
 	}
 	for j := 0; j < options.IslandDampeningPasses; j++ { // number of passes
-		for k := range level {
-			if len(level[k].Neighbors) == 1 {
-				for n := range level[k].Neighbors { // will only run once
-					mergeRegions(level, parents, n, k)
+		for _, k := range remaining(level, ordering) {
+			if level[k].merged { // already merged this pass
+				continue
+			}
+			if len(level[k].neighbors) == 1 {
+				for n := range level[k].neighbors { // will only run once
+					if !adminBlocks(options, level[n].admin, level[k].admin) {
+						mergeRegions(level, n, k)
+					}
 					break
 				}
 			}
@@ -220,45 +335,149 @@ func GenerateLevel(prevLevel map[string]project_types.Region, options *project_t
 	}
 
 	// merge small regions
-	if len(level) == 1 { // entire level merged; return
-		return level, parents
-	}
-	for k, region := range level {
-		if len(region.Tiles) <= options.SmallRegionMergeLimit && len(region.Neighbors) > 0 {
-			var smallestNeighbor project_types.Region
-			size := 569707381193163 // No region can have this many tiles
-			for n := range region.Neighbors {
-				if len(level[n].Tiles) < size {
-					smallestNeighbor = level[n]
-					size = len(smallestNeighbor.Tiles)
+	if len(remaining(level, ordering)) == 1 { // entire level merged; return
+		return finishLevel(level), unmetRegions(level, options, ordering)
+	}
+	for _, k := range remaining(level, ordering) {
+		if level[k].merged { // already merged into a neighbor
+			continue
+		}
+		if level[k].size <= options.SmallRegionMergeLimit && len(level[k].neighbors) > 0 {
+			smallestNeighbor := -1
+			size := 569707381193163.0 // No region can have this many tiles
+			for _, n := range orderedNeighbors(level[k].neighbors, level, ordering) {
+				if adminBlocks(options, level[n].admin, level[k].admin) {
+					continue
+				}
+				// neighbors across a soft admin-1 boundary count as larger
+				if weighted := float64(level[n].size) * adminPenalty(options, level[n].admin, level[k].admin); weighted < size {
+					smallestNeighbor = n
+					size = weighted
 				}
 			}
-			mergeRegions(level, parents, smallestNeighbor.Index, k)
+			if smallestNeighbor >= 0 {
+				mergeRegions(level, smallestNeighbor, k)
+			}
 		}
 	}
 
-	// give regions with zero neighbors a neighbor
-	if len(level) == 1 { // entire level merged; return
-		return level, parents
+	if options.RefinementPasses > 0 {
+		refineLevel(prevLevel, prevAdmins, prevSizes, level, parents, options, ordering)
 	}
-	sorted := []string{}
-	for tile := range level {
-		sorted = append(sorted, tile)
+
+	// merge regions that are still below the minimums
+	enforceMinimums(level, options, ordering)
+	unmet := unmetRegions(level, options, ordering)
+
+	// give regions with zero neighbors a neighbor
+	sorted := remaining(level, Ordering{})
+	if len(sorted) == 1 { // entire level merged; return
+		return finishLevel(level), unmet
 	}
-	sort.Strings(sorted)
-	for tile := range level {
-		if len(level[tile].Neighbors) == 0 {
-			index := sort.SearchStrings(sorted, tile)
+	for index, k := range sorted {
+		if len(level[k].neighbors) == 0 {
 			neighbor := sorted[(index+1)%len(sorted)]
-			level[tile].Neighbors[neighbor] = true
-			level[neighbor].Neighbors[tile] = true
+			level[k].neighbors[neighbor] = true
+			level[neighbor].neighbors[k] = true
+		}
+	}
+
+	return finishLevel(level), unmet
+}
+
+// finishLevel drops merged regions and converts the rest into a sorted Level
+func finishLevel(level []growingRegion) project_types.Level {
+	ids := remaining(level, Ordering{})
+	newIDs := make(map[int]project_types.RegionID, len(ids))
+	for newID, id := range ids {
+		newIDs[id] = project_types.RegionID(newID)
+	}
+	finished := make(project_types.Level, len(ids))
+	for newID, id := range ids {
+		neighbors := make([]project_types.RegionID, 0, len(level[id].neighbors))
+		for neighbor := range level[id].neighbors {
+			neighbors = append(neighbors, newIDs[neighbor])
+		}
+		sort.Slice(neighbors, func(a, b int) bool { return neighbors[a] < neighbors[b] })
+		finished[newID] = project_types.Region{
+			Index:      level[id].index,
+			Population: level[id].population,
+			Weights:    level[id].weights,
+			Tiles:      level[id].tiles,
+			Neighbors:  neighbors,
+			Centroid:   level[id].centroid,
+		}
+	}
+	return finished
+}
+
+// concatLevels joins independent levels into one sorted level
+func concatLevels(levels []project_types.Level) project_types.Level {
+	joined := project_types.Level{}
+	for _, level := range levels {
+		offset := project_types.RegionID(len(joined))
+		for _, region := range level {
+			neighbors := make([]project_types.RegionID, len(region.Neighbors))
+			for i, neighbor := range region.Neighbors {
+				neighbors[i] = neighbor + offset
+			}
+			region.Neighbors = neighbors
+			joined = append(joined, region)
+		}
+	}
+	return project_types.SortLevel(joined)
+}
+
+// crossBorderCountry is what countryLevels holds everything under once levels
+// may cross country borders
+const crossBorderCountry = "(cross-border)"
+
+// joinCountries concatenates every country's level and links regions that
+// touch across a border, so GenerateLevel can grow regions over it
+func joinCountries(countryLevels map[string]project_types.Level) project_types.Level {
+	countries := []project_types.Level{}
+	for _, country := range orderedKeys(countryLevels, Ordering{Deterministic: true}) {
+		countries = append(countries, countryLevels[country])
+	}
+	level := concatLevels(countries)
+	parents := level.TileParents()
+	linked := 0
+	for id := range level {
+		neighbors := map[project_types.RegionID]bool{}
+		for _, neighbor := range level[id].Neighbors {
+			neighbors[neighbor] = true
 		}
+		for _, tile := range utils.H3BorderTiles(level[id].Tiles) {
+			if neighbor, ok := parents[tile]; ok && !neighbors[neighbor] {
+				neighbors[neighbor] = true
+				level[id].Neighbors = append(level[id].Neighbors, neighbor)
+				linked++
+			}
+		}
+		sort.Slice(level[id].Neighbors, func(a, b int) bool { return level[id].Neighbors[a] < level[id].Neighbors[b] })
 	}
+	log.Printf("joined %d countries into %d regions with %d cross-border links\n", len(countryLevels), len(level), linked/2)
+	return level
+}
 
-	return level, parents
+// GenerateOptions configures GenerateAndWriteLevels beyond the tiles and level
+// options it generates from
+type GenerateOptions struct {
+	WeightMaps          project_types.WeightMaps // weights level options limit or balance, nil without weights
+	Admin               project_types.H3ToAdmin  // admin-1 area of every tile, nil without adminBoundary levels
+	Ocean               map[h3.H3Index]bool      // tiles assigned by the ocean policy
+	CrossBorderFrom     int                      // first level whose regions may cross country borders; -1 keeps every level inside its country
+	Format              fileio.LevelFormat
+	Ordering            Ordering
+	Lineage             LineageOptions
+	Checkpoint          CheckpointOptions
+	MemorySafeStitching bool // stitch every level before generating the next one instead of alongside it
 }
 
-func GenerateAndWriteLevels(popMap project_types.PopMap, countryToH3 project_types.CountryToH3, dirName string, resolution int, memorySafeStitching bool, options []project_types.LevelOptions) error {
+// GenerateAndWriteLevels generates every level one at a time. Each finished
+// level is written out and checkpointed before the next one is generated, and
+// only the newest level is kept in memory.
+func GenerateAndWriteLevels(popMap project_types.PopMap, countryToH3 project_types.CountryToH3, dirName string, resolution int, options []project_types.LevelOptions, generate GenerateOptions) error {
 	log.Print("calculating country centroids")
 	// get country neighbors
 	countryCentroids := map[string]h3.GeoCoord{}
@@ -266,6 +485,27 @@ func GenerateAndWriteLevels(popMap project_types.PopMap, countryToH3 project_typ
 		countryCentroids[country] = CountryCentroid(tiles)
 	}
 
+	checkpointDir := generate.Checkpoint.Dir
+	if checkpointDir == "" {
+		checkpointDir = path.Join(dirName, "checkpoint")
+	}
+	if path.Clean(checkpointDir) == path.Clean(dirName) {
+		return errors.New("the checkpoint directory can't be the output directory, their level files would collide")
+	}
+	check := checkpoint{dir: checkpointDir}
+	settings := checkpointSettings{
+		Resolution: resolution,
+		Ordering:   generate.Ordering,
+		Format:     generate.Format,
+		Lineage:    generate.Lineage,
+		Options:    options,
+		CrossFrom:  generate.CrossBorderFrom,
+		Inputs:     inputsHash(popMap, generate.WeightMaps, countryToH3, generate.Admin, generate.Ocean),
+	}
+	if err := check.open(settings, generate.Checkpoint.Resume); err != nil {
+		return err
+	}
+
 	// concurrency stuff
 	processes := runtime.GOMAXPROCS(runtime.NumCPU())
 	log.Printf("max processes running: %d\n", processes)
@@ -274,55 +514,96 @@ func GenerateAndWriteLevels(popMap project_types.PopMap, countryToH3 project_typ
 	mutex := sync.Mutex{}
 	errs := []error{}
 
-	log.Print("generating country level0's")
-	zeroLevels := map[string]project_types.Level{}
-	for country := range countryToH3 {
-		wg.Add(1)
-		guard <- struct{}{}
-		go func(country string) {
-			next, err := GenerateLevel0(popMap, countryToH3[country])
-			mutex.Lock()
-			errs = append(errs, err)
-			zeroLevels[country] = next
-			mutex.Unlock()
-			wg.Done()
-			<-guard
-		}(country)
-	}
-	wg.Wait()
-
-	for _, err := range errs {
-		if err != nil {
-			return err
+	finished, prevLevels, err := check.latest(len(options))
+	if err != nil {
+		return err
+	}
+	metadata := project_types.Metadata{Resolution: resolution, Levels: []project_types.LevelMetadata{}}
+	metadataPath := path.Join(dirName, "metadata.json")
+	if finished >= 0 {
+		log.Printf("resuming after level %d\n", finished)
+		if utils.FileExists(metadataPath) {
+			if err := utils.ReadJsonFile(metadataPath, &metadata); err != nil {
+				return err
+			}
+			if len(metadata.Levels) > finished+1 {
+				metadata.Levels = metadata.Levels[:finished+1]
+			}
+		}
+	} else {
+		log.Print("generating country level0's")
+		prevLevels = map[string]project_types.Level{}
+		for country := range countryToH3 {
+			wg.Add(1)
+			guard <- struct{}{}
+			go func(country string) {
+				next, err := GenerateLevel0(popMap, generate.WeightMaps, countryToH3[country])
+				mutex.Lock()
+				errs = append(errs, err)
+				prevLevels[country] = next
+				mutex.Unlock()
+				wg.Done()
+				<-guard
+			}(country)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
 		}
+		errs = []error{}
 	}
-	errs = []error{}
+
+	// stitching a level runs alongside generating the next one unless
+	// MemorySafeStitching is set
+	stitching := sync.WaitGroup{}
+	stitchErrs := make([]error, len(options))
 
 	log.Print("generating country levels")
-	countryLevels := make([]map[string]project_types.Level, len(options))
-	countryParents := make([]map[string]map[string]string, len(options))
-	for i := 0; i < len(options); i++ {
-		countryLevels[i] = map[string]project_types.Level{}
-		countryParents[i] = map[string]map[string]string{}
-		rangeObj := zeroLevels
-		if i > 0 {
-			rangeObj = countryLevels[i-1]
-		}
-		for country := range rangeObj {
-			var prevLevel project_types.Level
-			if i == 0 {
-				prevLevel = zeroLevels[country]
-			} else {
-				prevLevel = countryLevels[i-1][country]
+	for i := finished + 1; i < len(options); i++ {
+		if generate.CrossBorderFrom >= 0 && i >= generate.CrossBorderFrom && len(prevLevels) > 1 {
+			log.Printf("level %d and up may cross country borders\n", i)
+			prevLevels = map[string]project_types.Level{crossBorderCountry: joinCountries(prevLevels)}
+		}
+
+		plan, ok := check.plan(i)
+		if !ok {
+			plan = planLevel(prevLevels, options[i], generate.Ordering, generate.Admin, generate.Ocean, processes)
+			if err := check.savePlan(i, plan); err != nil {
+				return err
+			}
+		}
+
+		countryLevels := map[string]project_types.Level{}
+		unmet := []project_types.UnmetRegion{}
+		for country, prevLevel := range prevLevels {
+			if regions, loadedUnmet, ok := check.country(i, country); ok {
+				log.Printf("%s level %d loaded from checkpoint\n", country, i)
+				countryLevels[country] = regions
+				unmet = append(unmet, loadedUnmet...)
+				continue
+			}
+			if result, ok := plan.results[country]; ok { // generated while searching for a target
+				if err := check.saveCountry(i, country, result.level, result.unmet); err != nil {
+					return err
+				}
+				countryLevels[country] = result.level
+				unmet = append(unmet, result.unmet...)
+				continue
 			}
 			wg.Add(1)
 			guard <- struct{}{}
 			go func(country string, prevLevel project_types.Level) {
-				nextLevel, nextParents := GenerateLevel(prevLevel, &options[i])
+				nextLevel, levelUnmet := GenerateLevel(prevLevel, plan.optionsOf(country), generate.Ordering, generate.Admin, generate.Ocean)
+				levelUnmet = countryUnmet(levelUnmet, country)
+				err := check.saveCountry(i, country, nextLevel, levelUnmet)
 
 				mutex.Lock()
-				countryLevels[i][country] = nextLevel
-				countryParents[i][country] = nextParents
+				countryLevels[country] = nextLevel
+				unmet = append(unmet, levelUnmet...)
+				errs = append(errs, err)
 				mutex.Unlock()
 
 				log.Print(country)
@@ -331,77 +612,136 @@ func GenerateAndWriteLevels(popMap project_types.PopMap, countryToH3 project_typ
 			}(country, prevLevel)
 		}
 		wg.Wait()
+		// the previous level is written and checkpointed by now
+		prevLevels = nil
+
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
 
 		// merge finished countries
-		for country := range countryLevels[i] {
-			if len(countryLevels[i][country]) == 1 {
-				for _, region := range countryLevels[i][country] { // only run once
-					// find nearest neighbor
-					neighbor := ""
-					minDist := math.MaxFloat64
-					for curr, centroid := range countryCentroids {
-						calcDist := utils.Distance(countryCentroids[country].Latitude, countryCentroids[country].Longitude, centroid.Latitude, centroid.Longitude)
-						if calcDist < minDist && curr != country && len(countryLevels[i][curr]) != 0 {
-							minDist = calcDist
-							neighbor = curr
-						}
-					}
-					countryLevels[i][neighbor][region.Index] = region
-					for child := range countryParents[i][country] {
-						countryParents[i][neighbor][child] = region.Index
+		for _, country := range orderedKeys(countryLevels, generate.Ordering) {
+			if len(countryLevels[country]) == 1 {
+				region := countryLevels[country][0]
+				// find nearest neighbor
+				neighbor := ""
+				minDist := math.MaxFloat64
+				for _, curr := range orderedKeys(countryCentroids, generate.Ordering) {
+					centroid := countryCentroids[curr]
+					calcDist := utils.Distance(countryCentroids[country].Latitude, countryCentroids[country].Longitude, centroid.Latitude, centroid.Longitude)
+					if calcDist < minDist && curr != country && len(countryLevels[curr]) != 0 {
+						minDist = calcDist
+						neighbor = curr
 					}
-					for _, tile := range utils.H3BorderTiles(region.Tiles) {
-						if newNeighbor, ok := countryParents[i][neighbor][tile]; ok {
-							countryLevels[i][neighbor][region.Index].Neighbors[newNeighbor] = true
-							countryLevels[i][neighbor][newNeighbor].Neighbors[region.Index] = true
-						}
+				}
+				if neighbor == "" { // last country standing
+					continue
+				}
+				neighborLevel := append(countryLevels[neighbor], region)
+				regionID := project_types.RegionID(len(neighborLevel) - 1)
+				neighborLevel[regionID].Neighbors = []project_types.RegionID{}
+				neighborParents := neighborLevel.TileParents()
+				linked := map[project_types.RegionID]bool{}
+				for _, tile := range utils.H3BorderTiles(region.Tiles) {
+					if newNeighbor, ok := neighborParents[tile]; ok && !linked[newNeighbor] {
+						linked[newNeighbor] = true
+						neighborLevel[regionID].Neighbors = append(neighborLevel[regionID].Neighbors, newNeighbor)
+						neighborLevel[newNeighbor].Neighbors = append(neighborLevel[newNeighbor].Neighbors, regionID)
 					}
-					break
 				}
-				delete(countryLevels[i], country)
-				delete(countryParents[i], country)
+				countryLevels[neighbor] = project_types.SortLevel(neighborLevel)
+				delete(countryLevels, country)
+			}
+		}
+
+		// checkpoints have to be finished in order
+		stitching.Wait()
+		for _, err := range stitchErrs {
+			if err != nil {
+				return err
+			}
+		}
+		stitching.Add(1)
+		go func(j int, countryLevels map[string]project_types.Level, unmet []project_types.UnmetRegion, plan levelPlan) {
+			defer stitching.Done()
+			regions, err := stitchLevel(countryLevels, unmet, &options[j], dirName, j, generate.Format, generate.Lineage)
+			if err != nil {
+				stitchErrs[j] = err
+				return
+			}
+			levelMetadata := project_types.LevelMetadata{Level: j, Regions: regions, Options: plan.Options}
+			if len(plan.Countries) > 0 {
+				levelMetadata.Countries = plan.Countries
+			}
+			metadata.Levels = append(metadata.Levels, levelMetadata)
+			if err := utils.WriteAsJsonFile(metadata, metadataPath); err != nil {
+				stitchErrs[j] = err
+				return
 			}
+			stitchErrs[j] = check.finish(j, countryLevels)
+		}(i, countryLevels, unmet, plan)
+		if generate.MemorySafeStitching {
+			stitching.Wait()
 		}
+		prevLevels = countryLevels
 	}
+	stitching.Wait()
 
-	log.Print("stitching global levels")
-	if memorySafeStitching {
-		for i := 0; i < processes-1; i++ {
-			guard <- struct{}{}
+	for _, err := range stitchErrs {
+		if err != nil {
+			return err
 		}
 	}
 
-	count := 0
-	for i := 0; i < len(options); i++ {
-		wg.Add(1)
-		guard <- struct{}{}
-		go func(j int) {
-			level := project_types.Level{}
-			parents := map[string]string{}
-			for country := range countryLevels[j] {
-				for tileIndex, region := range countryLevels[j][country] {
-					level[tileIndex] = region
-				}
-				for child, parent := range countryParents[j][country] {
-					parents[child] = parent
-				}
-				count++
-				if count%100 == 0 {
-					log.Print(count)
-				}
-			}
-			utils.WriteAsJsonFile(level, path.Join(dirName, fmt.Sprintf("level%d.json", j)))
-			utils.WriteAsJsonFile(parents, path.Join(dirName, fmt.Sprintf("parents%d.json", j)))
-			log.Print("total regions and size of parents:")
-			log.Print(len(level), len(parents))
-			log.Print("total tiles and population:")
-			log.Print(project_types.LevelTotalTiles(level), project_types.LevelTotalPop(level))
+	return check.remove()
+}
 
-			wg.Done()
-			<-guard
-		}(i)
+// stitchLevel joins every country's regions into a global level and writes it
+func stitchLevel(countryLevels map[string]project_types.Level, unmet []project_types.UnmetRegion, options *project_types.LevelOptions, dirName string, levelIndex int, format fileio.LevelFormat, lineageOptions LineageOptions) (int, error) {
+	log.Printf("stitching global level %d\n", levelIndex)
+	countries := []project_types.Level{}
+	for _, country := range orderedKeys(countryLevels, Ordering{Deterministic: true}) {
+		countries = append(countries, countryLevels[country])
 	}
-	wg.Wait()
-
-	return nil
+	level := concatLevels(countries)
+	if lineageOptions.PrevDir != "" {
+		prevLevel := project_types.Level{}
+		if prevCount, err := fileio.CountLevels(lineageOptions.PrevDir); err != nil || levelIndex >= prevCount {
+			log.Printf("level %d not found in %s, every region is new\n", levelIndex, lineageOptions.PrevDir)
+		} else if prevLevel, err = fileio.ReadLevelFromDir(lineageOptions.PrevDir, levelIndex); err != nil {
+			return 0, err
+		}
+		var lineage project_types.Lineage
+		var err error
+		if level, lineage, err = StabilizeLevel(level, prevLevel, lineageOptions); err != nil {
+			return 0, fmt.Errorf("level %d: %w", levelIndex, err)
+		}
+		log.Printf("level %d lineage: %d kept, %d created, %d retired\n", levelIndex, len(lineage.Kept), len(lineage.Created), len(lineage.Retired))
+		if err := utils.WriteAsJsonFile(lineage, path.Join(dirName, fmt.Sprintf("lineage%d.json", levelIndex))); err != nil {
+			return 0, err
+		}
+	}
+	if err := fileio.WriteLevel(level, dirName, levelIndex, format); err != nil {
+		return 0, err
+	}
+	if hasMinimums(options) {
+		renameUnmet(unmet, level)
+		log.Printf("level %d: %d regions below their minimums\n", levelIndex, len(unmet))
+		if err := utils.WriteAsJsonFile(unmet, path.Join(dirName, fmt.Sprintf("unmet%d.json", levelIndex))); err != nil {
+			return 0, err
+		}
+	}
+	log.Print("total regions:")
+	log.Print(len(level))
+	log.Print("total tiles and population:")
+	log.Print(project_types.LevelTotalTiles(level), project_types.LevelTotalPop(level))
+	if totals := project_types.LevelTotalWeights(level); totals != nil {
+		for _, total := range totals {
+			log.Printf("total %s: %.1f\n", total.Name, total.Value)
+		}
+	}
+	log.Printf("level %d balance: %s\n", levelIndex, levelBalance(level))
+	return len(level), nil
 }
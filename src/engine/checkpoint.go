@@ -0,0 +1,323 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+
+	"github.com/mappichat/regions-engine/src/fileio"
+	"github.com/mappichat/regions-engine/src/project_types"
+	"github.com/mappichat/regions-engine/src/utils"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// CheckpointOptions controls where GenerateAndWriteLevels persists finished
+// work and whether it picks up from a previous run.
+type CheckpointOptions struct {
+	Dir    string // defaults to {output directory}/checkpoint
+	Resume bool   // reuse work found in Dir instead of starting over
+}
+
+// A checkpoint directory looks like this:
+//
+//	settings.json                     the inputs it was written for, resuming with different ones is an error
+//	level{N}/plan.json                the options every country of level N is generated with
+//	level{N}/countries/{country}.bin  a country's level N as generated, before finished countries are merged
+//	level{N}/countries/{country}.json the regions of it that are below the level's minimums
+//	level{N}/merged/{country}.bin     every country's level N after merging
+//	level{N}.json                     written last, once level N is merged and its output files are written
+//
+// Only the newest finished level is needed to continue, so older ones are
+// removed as soon as the next one finishes. The checkpointer only ever removes
+// these files, anything else in the directory is left alone.
+type checkpoint struct {
+	dir string
+}
+
+type checkpointSettings struct {
+	Resolution int
+	Ordering   Ordering
+	Format     fileio.LevelFormat
+	Lineage    LineageOptions
+	Options    []project_types.LevelOptions
+	CrossFrom  int
+	Inputs     string // inputsHash of the tiles the levels are generated from
+}
+
+type levelManifest struct {
+	Countries []string `json:"countries"`
+}
+
+func (c checkpoint) settingsPath() string {
+	return path.Join(c.dir, "settings.json")
+}
+
+func (c checkpoint) manifestPath(level int) string {
+	return path.Join(c.dir, fmt.Sprintf("level%d.json", level))
+}
+
+func (c checkpoint) levelDir(level int) string {
+	return path.Join(c.dir, fmt.Sprintf("level%d", level))
+}
+
+// country names can contain anything, including slashes
+func (c checkpoint) countryPath(level int, country string) string {
+	return path.Join(c.levelDir(level), "countries", url.PathEscape(country)+".bin")
+}
+
+func (c checkpoint) unmetPath(level int, country string) string {
+	return path.Join(c.levelDir(level), "countries", url.PathEscape(country)+".json")
+}
+
+func (c checkpoint) planPath(level int) string {
+	return path.Join(c.levelDir(level), "plan.json")
+}
+
+func (c checkpoint) mergedPath(level int, country string) string {
+	return path.Join(c.levelDir(level), "merged", url.PathEscape(country)+".bin")
+}
+
+// checkpointFile matches the names the checkpointer writes in its directory
+var checkpointFile = regexp.MustCompile(`^(settings\.json|level\d+(\.json)?)(\.tmp)?$`)
+
+// open prepares the checkpoint directory. Without resume, or when the
+// directory was written for different settings, it starts out without a
+// checkpoint. A directory that holds other files and no checkpoint is refused,
+// so a mistyped path can't lose anything.
+func (c checkpoint) open(settings checkpointSettings, resume bool) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 && !utils.FileExists(c.settingsPath()) {
+		return fmt.Errorf("checkpoint directory %s is not empty and holds no checkpoint, use an empty or new directory", c.dir)
+	}
+	if resume && utils.FileExists(c.settingsPath()) {
+		previous := checkpointSettings{}
+		if err := utils.ReadJsonFile(c.settingsPath(), &previous); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(previous, settings) {
+			return fmt.Errorf("checkpoint in %s was written with different inputs or options, run without -resume to start over", c.dir)
+		}
+		return nil
+	}
+	if resume {
+		log.Printf("no checkpoint found in %s, starting from scratch\n", c.dir)
+	}
+	if err := c.remove(); err != nil {
+		return err
+	}
+	return writeJsonAtomic(settings, c.settingsPath())
+}
+
+// latest returns the newest finished level and every country's regions in it,
+// or -1 if no level has finished yet
+func (c checkpoint) latest(levels int) (int, map[string]project_types.Level, error) {
+	for i := levels - 1; i >= 0; i-- {
+		if !utils.FileExists(c.manifestPath(i)) {
+			continue
+		}
+		manifest := levelManifest{}
+		if err := utils.ReadJsonFile(c.manifestPath(i), &manifest); err != nil {
+			return -1, nil, err
+		}
+		countryLevels := make(map[string]project_types.Level, len(manifest.Countries))
+		for _, country := range manifest.Countries {
+			level, err := fileio.ReadLevel(c.mergedPath(i, country))
+			if err != nil {
+				return -1, nil, fmt.Errorf("reading checkpoint of %s level %d: %w", country, i, err)
+			}
+			countryLevels[country] = level
+		}
+		return i, countryLevels, nil
+	}
+	return -1, nil, nil
+}
+
+// plan returns the options a level was planned with before a crash, so target
+// searches don't have to run again
+func (c checkpoint) plan(level int) (levelPlan, bool) {
+	plan := levelPlan{}
+	if !utils.FileExists(c.planPath(level)) {
+		return plan, false
+	}
+	if err := utils.ReadJsonFile(c.planPath(level), &plan); err != nil {
+		log.Printf("ignoring checkpoint of level %d plan: %s\n", level, err.Error())
+		return plan, false
+	}
+	plan.results = map[string]generated{}
+	return plan, true
+}
+
+func (c checkpoint) savePlan(level int, plan levelPlan) error {
+	return writeJsonAtomic(plan, c.planPath(level))
+}
+
+// country returns a country's level if it was generated before a crash
+func (c checkpoint) country(level int, country string) (project_types.Level, []project_types.UnmetRegion, bool) {
+	filePath := c.countryPath(level, country)
+	if !utils.FileExists(filePath) {
+		return nil, nil, false
+	}
+	regions, err := fileio.ReadLevel(filePath)
+	if err != nil {
+		log.Printf("ignoring checkpoint of %s level %d: %s\n", country, level, err.Error())
+		return nil, nil, false
+	}
+	unmet := []project_types.UnmetRegion{}
+	if utils.FileExists(c.unmetPath(level, country)) {
+		if err := utils.ReadJsonFile(c.unmetPath(level, country), &unmet); err != nil {
+			log.Printf("ignoring checkpoint of %s level %d: %s\n", country, level, err.Error())
+			return nil, nil, false
+		}
+	}
+	return regions, unmet, true
+}
+
+// the report is written before the level, so a checkpointed level without one
+// had nothing to report
+func (c checkpoint) saveCountry(level int, country string, regions project_types.Level, unmet []project_types.UnmetRegion) error {
+	if len(unmet) > 0 {
+		if err := writeJsonAtomic(unmet, c.unmetPath(level, country)); err != nil {
+			return err
+		}
+	}
+	return writeLevelAtomic(regions, c.countryPath(level, country))
+}
+
+// finish records level as done and drops the level before it
+func (c checkpoint) finish(level int, countryLevels map[string]project_types.Level) error {
+	manifest := levelManifest{Countries: orderedKeys(countryLevels, Ordering{Deterministic: true})}
+	for _, country := range manifest.Countries {
+		if err := writeLevelAtomic(countryLevels[country], c.mergedPath(level, country)); err != nil {
+			return err
+		}
+	}
+	if err := writeJsonAtomic(manifest, c.manifestPath(level)); err != nil {
+		return err
+	}
+	if level > 0 {
+		if err := os.Remove(c.manifestPath(level - 1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.RemoveAll(c.levelDir(level - 1))
+	}
+	return nil
+}
+
+// remove deletes what the checkpointer wrote, and the directory once nothing
+// else is left in it
+func (c checkpoint) remove() error {
+	entries, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	left := 0
+	for _, entry := range entries {
+		if !checkpointFile.MatchString(entry.Name()) {
+			left++
+			continue
+		}
+		if err := os.RemoveAll(path.Join(c.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if left > 0 {
+		return nil
+	}
+	return os.Remove(c.dir)
+}
+
+// inputsHash fingerprints every country's tiles, their population and weights,
+// their admin-1 areas and the ocean tiles, so a checkpoint is only resumed
+// with the inputs it was written for and not just ones that add up the same
+func inputsHash(popMap project_types.PopMap, weightMaps project_types.WeightMaps, countryToH3 project_types.CountryToH3, h3ToAdmin project_types.H3ToAdmin, ocean map[h3.H3Index]bool) string {
+	hasher := fnv.New64a()
+	buf := make([]byte, 8)
+	writeUint := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf, v)
+		hasher.Write(buf)
+	}
+	writeString := func(s string) {
+		writeUint(uint64(len(s)))
+		hasher.Write([]byte(s))
+	}
+	writeTiles := func(tiles []h3.H3Index, write func(tile h3.H3Index)) {
+		sortByIndex(tiles, func(tile h3.H3Index) h3.H3Index { return tile }, Ordering{Deterministic: true})
+		writeUint(uint64(len(tiles)))
+		for _, tile := range tiles {
+			writeUint(uint64(tile))
+			write(tile)
+		}
+	}
+	writePopMap := func(popMap project_types.PopMap) {
+		tiles := make([]h3.H3Index, 0, len(popMap))
+		for tile := range popMap {
+			tiles = append(tiles, tile)
+		}
+		writeTiles(tiles, func(tile h3.H3Index) { writeUint(math.Float64bits(popMap[tile])) })
+	}
+
+	writeUint(uint64(len(countryToH3)))
+	for _, country := range orderedKeys(countryToH3, Ordering{Deterministic: true}) {
+		writeString(country)
+		writeTiles(append([]h3.H3Index{}, countryToH3[country]...), func(h3.H3Index) {})
+	}
+	writePopMap(popMap)
+	names := weightNamesOf(weightMaps)
+	writeUint(uint64(len(names)))
+	for _, name := range names {
+		writeString(name)
+		writePopMap(weightMaps[name])
+	}
+	adminTiles := make([]h3.H3Index, 0, len(h3ToAdmin))
+	for tile := range h3ToAdmin {
+		adminTiles = append(adminTiles, tile)
+	}
+	writeTiles(adminTiles, func(tile h3.H3Index) { writeString(h3ToAdmin[tile]) })
+	oceanTiles := make([]h3.H3Index, 0, len(ocean))
+	for tile, isOcean := range ocean {
+		if isOcean {
+			oceanTiles = append(oceanTiles, tile)
+		}
+	}
+	writeTiles(oceanTiles, func(h3.H3Index) {})
+	return fmt.Sprintf("%016x", hasher.Sum64())
+}
+
+// files are written next to their destination and renamed into place so a
+// crash never leaves half a file behind
+func writeLevelAtomic(level project_types.Level, filePath string) error {
+	tmpPath := filePath + ".tmp"
+	if err := fileio.WriteLevelBinary(level, tmpPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+func writeJsonAtomic(v any, filePath string) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+)
+
+func TestCheckpointRefusesChangedInputs(t *testing.T) {
+	quietLog(t)
+	countryToH3, popMap := testCountries()
+	settings := func(popMap project_types.PopMap) checkpointSettings {
+		return checkpointSettings{Resolution: 4, Options: testOptions(), Inputs: inputsHash(popMap, nil, countryToH3, nil, nil)}
+	}
+	check := checkpoint{dir: filepath.Join(t.TempDir(), "checkpoint")}
+	if err := check.open(settings(popMap), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := check.open(settings(popMap), true); err != nil {
+		t.Fatalf("resuming with the same inputs: %s", err)
+	}
+
+	// move population between two tiles so every total stays the same
+	swapped := project_types.PopMap{}
+	for tile, pop := range popMap {
+		swapped[tile] = pop
+	}
+	tiles := countryToH3["c2"]
+	swapped[tiles[0]], swapped[tiles[1]] = popMap[tiles[0]]+1, popMap[tiles[1]]-1
+	if err := check.open(settings(swapped), true); err == nil || !strings.Contains(err.Error(), "different inputs") {
+		t.Fatalf("got error %v resuming with a changed popmap", err)
+	}
+}
@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	"github.com/mappichat/regions-engine/src/utils"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// DisputedCountry holds the tiles claimed by several countries under the
+// disputed contested policy
+const DisputedCountry = "(disputed)"
+
+const (
+	ContestedPriority = "priority" // the claimant first in Priority wins
+	ContestedLargest  = "largest"  // the claimant covering most of the tile wins
+	ContestedDisputed = "disputed" // nobody wins, the tile goes to DisputedCountry
+)
+
+// contestedSamples is how many resolutions finer the points are that measure
+// how much of a tile every claimant covers
+const contestedSamples = 2
+
+// ContestedPolicy decides who gets tiles that the polygons of several
+// countries cover. Countries missing from Priority rank after the listed ones
+// in code order, so every policy is deterministic.
+type ContestedPolicy struct {
+	Mode     string
+	Priority []string
+}
+
+func ParseContestedMode(mode string) (string, error) {
+	switch mode {
+	case ContestedPriority, ContestedLargest, ContestedDisputed:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown contested tile policy %q, use %s, %s or %s", mode, ContestedPriority, ContestedLargest, ContestedDisputed)
+}
+
+// resolveContested picks the country every tile in claims goes to according to policy
+func resolveContested(claims map[h3.H3Index][]string, countryPolygons project_types.CountryPolygons, resolution int, policy ContestedPolicy) map[h3.H3Index]string {
+	rank := map[string]int{}
+	for i, country := range policy.Priority {
+		if _, ok := rank[country]; !ok {
+			rank[country] = i
+		}
+	}
+	before := func(a string, b string) bool {
+		rankA, okA := rank[a]
+		rankB, okB := rank[b]
+		if okA != okB {
+			return okA
+		}
+		if okA && rankA != rankB {
+			return rankA < rankB
+		}
+		return a < b
+	}
+
+	bounds := map[string][]bbox{}
+	winners := make(map[h3.H3Index]string, len(claims))
+	for tile, claimants := range claims {
+		sort.Slice(claimants, func(i, j int) bool { return before(claimants[i], claimants[j]) })
+		switch policy.Mode {
+		case ContestedDisputed:
+			winners[tile] = DisputedCountry
+		case ContestedLargest:
+			samples := h3.ToChildren(tile, resolution+contestedSamples)
+			best := -1
+			for _, country := range claimants {
+				if _, ok := bounds[country]; !ok {
+					bounds[country] = polygonBounds(countryPolygons[country])
+				}
+				covered := 0
+				for _, sample := range samples {
+					if countryContains(countryPolygons[country], bounds[country], h3.ToGeo(sample)) {
+						covered++
+					}
+				}
+				if covered > best { // ties go to the higher priority
+					best = covered
+					winners[tile] = country
+				}
+			}
+		default:
+			winners[tile] = claimants[0]
+		}
+	}
+	log.Printf("%d tiles are claimed by more than one country, resolved by %s\n", len(claims), policy.Mode)
+	return winners
+}
+
+// contestedReport lists every contested tile, sorted by tile
+func contestedReport(claims map[h3.H3Index][]string, winners map[h3.H3Index]string) []project_types.ContestedTile {
+	report := make([]project_types.ContestedTile, 0, len(claims))
+	for tile, claimants := range claims {
+		sorted := append([]string{}, claimants...)
+		sort.Strings(sorted)
+		report = append(report, project_types.ContestedTile{Tile: h3.ToString(tile), Claimants: sorted, Country: winners[tile]})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Tile < report[j].Tile })
+	return report
+}
+
+type bbox struct {
+	minLat, maxLat, minLng, maxLng float64
+}
+
+func polygonBounds(polygons []h3.GeoPolygon) []bbox {
+	bounds := make([]bbox, len(polygons))
+	for i, polygon := range polygons {
+		b := bbox{math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)}
+		for _, coord := range polygon.Geofence {
+			b.minLat = math.Min(b.minLat, coord.Latitude)
+			b.maxLat = math.Max(b.maxLat, coord.Latitude)
+			b.minLng = math.Min(b.minLng, coord.Longitude)
+			b.maxLng = math.Max(b.maxLng, coord.Longitude)
+		}
+		bounds[i] = b
+	}
+	return bounds
+}
+
+func countryContains(polygons []h3.GeoPolygon, bounds []bbox, coord h3.GeoCoord) bool {
+	for i, polygon := range polygons {
+		b := bounds[i]
+		if coord.Latitude < b.minLat || coord.Latitude > b.maxLat || coord.Longitude < b.minLng || coord.Longitude > b.maxLng {
+			continue
+		}
+		if !utils.RingContains(polygon.Geofence, coord) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon.Holes {
+			if utils.RingContains(hole, coord) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
@@ -8,30 +8,67 @@ import (
 	"github.com/uber/h3-go/v3"
 )
 
-func GenerateCountryMaps(countryPolygons project_types.CountryPolygons, resolution int, coastFill int) (project_types.H3ToCountry, project_types.CountryToH3) {
+// GenerateCountryMaps assigns tiles to countries. Tiles covered by the
+// polygons of several countries go to the one contested picks, and are listed
+// in the returned report.
+func GenerateCountryMaps(countryPolygons project_types.CountryPolygons, resolution int, coastFill int, ordering Ordering, contested ContestedPolicy) (project_types.H3ToCountry, project_types.CountryToH3, []project_types.ContestedTile) {
 	h3ToCountry := project_types.H3ToCountry{}
 	countryToH3 := project_types.CountryToH3{}
 	log.Print("assigning tiles to countries")
-	for country, polygons := range countryPolygons {
-		tiles := []string{}
+	// polygons can overlap, so every claim is collected before tiles are assigned
+	claimed := map[string][]h3.H3Index{}
+	claims := map[h3.H3Index][]string{}
+	for _, country := range orderedKeys(countryPolygons, ordering) {
+		polygons := countryPolygons[country]
+		tiles := []h3.H3Index{}
 		for _, polygon := range polygons {
-			for _, h := range h3.Polyfill(polygon, resolution) {
-				tile := h3.ToString(h)
+			for _, tile := range h3.Polyfill(polygon, resolution) {
 				tiles = append(tiles, tile)
-				h3ToCountry[tile] = country
+				owner, ok := h3ToCountry[tile]
+				if !ok {
+					h3ToCountry[tile] = country
+				} else if owner != country {
+					if claims[tile] == nil {
+						claims[tile] = []string{owner}
+					}
+					if !containsString(claims[tile], country) {
+						claims[tile] = append(claims[tile], country)
+					}
+				}
 			}
 		}
-		countryToH3[country] = tiles
+		claimed[country] = tiles
 		log.Print(country)
 	}
+	winners := resolveContested(claims, countryPolygons, resolution, contested)
+	for tile, country := range winners {
+		h3ToCountry[tile] = country
+	}
+	for _, country := range orderedKeys(claimed, ordering) {
+		tiles := []h3.H3Index{}
+		seen := map[h3.H3Index]bool{}
+		for _, tile := range claimed[country] {
+			if h3ToCountry[tile] == country && !seen[tile] {
+				seen[tile] = true
+				tiles = append(tiles, tile)
+			}
+		}
+		countryToH3[country] = tiles
+	}
+	report := contestedReport(claims, winners)
+	if contested.Mode == ContestedDisputed {
+		for _, entry := range report {
+			countryToH3[DisputedCountry] = append(countryToH3[DisputedCountry], h3.FromString(entry.Tile))
+		}
+	}
 
 	// give countries of size 0 some tiles
 	log.Print("giving zero tile countries some tiles")
-	for country, tiles := range countryToH3 {
-		if len(tiles) == 0 {
+	for _, country := range orderedKeys(countryToH3, ordering) {
+		if len(countryToH3[country]) == 0 {
 			for _, polygon := range countryPolygons[country] {
 				for _, coord := range polygon.Geofence {
-					tile := h3.ToString(h3.FromGeo(coord, resolution))
+					tile := h3.FromGeo(coord, resolution)
 					if _, ok := h3ToCountry[tile]; !ok {
 						h3ToCountry[tile] = country
 						countryToH3[country] = append(countryToH3[country], tile)
@@ -44,10 +81,9 @@ func GenerateCountryMaps(countryPolygons project_types.CountryPolygons, resoluti
 
 	// Assign coastline and unclaimed tiles to countries
 	log.Print("assigning coast and unnassigned land near coast")
-	for country, tiles := range countryToH3 {
-		for _, tile := range utils.H3BorderTiles(tiles) {
-			for _, h := range h3.KRing(h3.FromString(tile), coastFill) {
-				neighbor := h3.ToString(h)
+	for _, country := range orderedKeys(countryToH3, ordering) {
+		for _, tile := range utils.H3BorderTiles(countryToH3[country]) {
+			for _, neighbor := range h3.KRing(tile, coastFill) {
 				if _, ok := h3ToCountry[neighbor]; !ok {
 					h3ToCountry[neighbor] = country
 					countryToH3[country] = append(countryToH3[country], neighbor)
@@ -57,17 +93,36 @@ func GenerateCountryMaps(countryPolygons project_types.CountryPolygons, resoluti
 		// log.Printf("%s size: %d\n", country, len(tiles))
 	}
 
-	return h3ToCountry, countryToH3
+	return h3ToCountry, countryToH3, report
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func CountryCentroid(tiles []h3.H3Index) h3.GeoCoord {
+	return calcCentroid(tiles)
 }
 
-func CountryCentroid(tiles []string) h3.GeoCoord {
-	latsum := 0.0
-	lonsum := 0.0
-	for i := range tiles {
-		h := h3.ToGeo(h3.FromString(tiles[i]))
-		latsum += h.Latitude
-		lonsum += h.Longitude
+// GenerateAdminMap assigns tiles to the admin-1 areas whose polygons cover them.
+// Coast tiles outside every polygon stay unassigned.
+func GenerateAdminMap(adminPolygons project_types.CountryPolygons, resolution int, ordering Ordering) project_types.H3ToAdmin {
+	h3ToAdmin := project_types.H3ToAdmin{}
+	log.Print("assigning tiles to admin-1 areas")
+	for _, admin := range orderedKeys(adminPolygons, ordering) {
+		for _, polygon := range adminPolygons[admin] {
+			for _, tile := range h3.Polyfill(polygon, resolution) {
+				if _, ok := h3ToAdmin[tile]; !ok {
+					h3ToAdmin[tile] = admin
+				}
+			}
+		}
 	}
-	n := len(tiles)
-	return h3.GeoCoord{Latitude: latsum / float64(n), Longitude: lonsum / float64(n)}
+	log.Printf("%d tiles in %d admin-1 areas\n", len(h3ToAdmin), len(adminPolygons))
+	return h3ToAdmin
 }
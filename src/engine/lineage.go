@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// DefaultLineageMinShare is the MinShare used unless configured. Above 0.5 no
+// region could be reported as split, since at most one new region would hold
+// that much of it.
+const DefaultLineageMinShare = 0.25
+
+type LineageOptions struct {
+	PrevDir    string  // data directory of the previous generation; empty disables matching
+	MinOverlap float64 // shared tiles / max(old size, new size) required to keep an id
+	MinShare   float64 // fraction of a previous region's tiles a new region needs for the two to be linked by a split or merge
+}
+
+type overlap struct {
+	current  project_types.RegionID
+	previous project_types.RegionID
+	tiles    int
+}
+
+// StabilizeLevel renames the regions of level so that regions that mostly
+// cover the same tiles as a region in prevLevel keep that region's id. New
+// regions never take an id that existed in the previous generation, so retired
+// ids are never reused for a different area. It fails when a new region has no
+// tile left to take a fresh id from.
+func StabilizeLevel(level project_types.Level, prevLevel project_types.Level, options LineageOptions) (project_types.Level, project_types.Lineage, error) {
+	prevParents := prevLevel.TileParents()
+
+	overlaps := []overlap{}
+	for id, region := range level {
+		shared := map[project_types.RegionID]int{}
+		for _, tile := range region.Tiles {
+			if prev, ok := prevParents[tile]; ok {
+				shared[prev]++
+			}
+		}
+		for prev, tiles := range shared {
+			overlaps = append(overlaps, overlap{current: project_types.RegionID(id), previous: prev, tiles: tiles})
+		}
+	}
+	sort.Slice(overlaps, func(i, j int) bool {
+		if overlaps[i].tiles != overlaps[j].tiles {
+			return overlaps[i].tiles > overlaps[j].tiles
+		}
+		if overlaps[i].current != overlaps[j].current {
+			return overlaps[i].current < overlaps[j].current
+		}
+		return overlaps[i].previous < overlaps[j].previous
+	})
+
+	// greedily keep previous ids, largest overlaps first
+	rename := make([]h3.H3Index, len(level))
+	used := map[h3.H3Index]bool{}
+	for _, o := range overlaps {
+		if rename[o.current] != 0 || used[prevLevel[o.previous].Index] {
+			continue
+		}
+		size := len(level[o.current].Tiles)
+		if prevSize := len(prevLevel[o.previous].Tiles); prevSize > size {
+			size = prevSize
+		}
+		if float64(o.tiles)/float64(size) >= options.MinOverlap {
+			rename[o.current] = prevLevel[o.previous].Index
+			used[prevLevel[o.previous].Index] = true
+		}
+	}
+
+	// unmatched regions get an id that was never used before
+	existed := func(index h3.H3Index) bool {
+		_, ok := prevLevel.Find(index)
+		return ok
+	}
+	for id, region := range level {
+		if rename[id] != 0 {
+			continue
+		}
+		index := region.Index
+		if existed(index) || used[index] {
+			index = 0
+			tiles := append([]h3.H3Index{}, region.Tiles...)
+			sort.Slice(tiles, func(i, j int) bool { return tiles[i] < tiles[j] })
+			for _, tile := range tiles {
+				if !existed(tile) && !used[tile] {
+					index = tile
+					break
+				}
+			}
+			if index == 0 {
+				return nil, project_types.Lineage{}, fmt.Errorf("region %s has no tile that was not already a region id", h3.ToString(region.Index))
+			}
+		}
+		rename[id] = index
+		used[index] = true
+	}
+
+	renamed := make(project_types.Level, len(level))
+	for id, region := range level {
+		region.Index = rename[id]
+		renamed[id] = region
+	}
+	renamed = project_types.SortLevel(renamed)
+
+	lineage := project_types.Lineage{
+		Kept:    []string{},
+		Created: []string{},
+		Retired: []string{},
+		Splits:  map[string][]string{},
+		Merges:  map[string][]string{},
+	}
+	for _, region := range renamed {
+		if existed(region.Index) {
+			lineage.Kept = append(lineage.Kept, h3.ToString(region.Index))
+		} else {
+			lineage.Created = append(lineage.Created, h3.ToString(region.Index))
+		}
+	}
+	for _, region := range prevLevel {
+		if _, ok := renamed.Find(region.Index); !ok {
+			lineage.Retired = append(lineage.Retired, h3.ToString(region.Index))
+		}
+	}
+	for _, o := range overlaps {
+		if float64(o.tiles)/float64(len(prevLevel[o.previous].Tiles)) < options.MinShare {
+			continue
+		}
+		previous := h3.ToString(prevLevel[o.previous].Index)
+		current := h3.ToString(rename[o.current])
+		lineage.Splits[previous] = append(lineage.Splits[previous], current)
+		lineage.Merges[current] = append(lineage.Merges[current], previous)
+	}
+	for prev, ids := range lineage.Splits {
+		if len(ids) < 2 {
+			delete(lineage.Splits, prev)
+		} else {
+			sort.Strings(ids)
+		}
+	}
+	for id, prevs := range lineage.Merges {
+		if len(prevs) < 2 {
+			delete(lineage.Merges, id)
+		} else {
+			sort.Strings(prevs)
+		}
+	}
+
+	return renamed, lineage, nil
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// isolatedReason is why a region without neighbors stays below the minimums.
+// Levels generated per country say which country it is alone in, see
+// countryUnmet.
+const isolatedReason = "isolated: no neighboring region to merge with"
+
+// unmetConstraints lists the minimums a region of the given size breaks
+func unmetConstraints(population float64, weights project_types.Weights, size int, options *project_types.LevelOptions) []string {
+	unmet := []string{}
+	if population < options.MinPop {
+		unmet = append(unmet, "minPopulation")
+	}
+	if size < options.MinRegionSize {
+		unmet = append(unmet, "minRegionSize")
+	}
+	if len(options.Weights) > 0 {
+		unmet = append(unmet, newWeighing(options).unmet(weights)...)
+	}
+	return unmet
+}
+
+// mergeTarget picks the neighbor a region below the minimums should merge
+// into: the least populated one (by the objective) that can take it without
+// going over MaxPop, MaxRegionSize or a weight maximum, preferring neighbors in
+// the same admin-1 area. If there is none it returns -1 and the reason.
+func mergeTarget(level []growingRegion, k int, options *project_types.LevelOptions, ordering Ordering) (int, string) {
+	if len(level[k].neighbors) == 0 {
+		return -1, isolatedReason
+	}
+	weighing := newWeighing(options)
+	target := -1
+	tooPopulated := 0
+	tooLarge := 0
+	tooHeavy := 0
+	acrossBoundary := 0
+	for _, n := range orderedNeighbors(level[k].neighbors, level, ordering) {
+		if adminBlocks(options, level[n].admin, level[k].admin) {
+			acrossBoundary++
+			continue
+		}
+		fits := true
+		if level[n].population+level[k].population > options.MaxPop {
+			tooPopulated++
+			fits = false
+		}
+		if level[n].size+level[k].size > options.MaxRegionSize {
+			tooLarge++
+			fits = false
+		}
+		if weighing.exceeds(level[n].weights, level[k].weights) {
+			tooHeavy++
+			fits = false
+		}
+		if !fits {
+			continue
+		}
+		if target < 0 {
+			target = n
+			continue
+		}
+		crosses, targetCrosses := crossesAdmin(level[n].admin, level[k].admin), crossesAdmin(level[target].admin, level[k].admin)
+		if crosses != targetCrosses {
+			if !crosses {
+				target = n
+			}
+		} else if score, targetScore := weighing.score(level[n].population, level[n].weights), weighing.score(level[target].population, level[target].weights); score < targetScore ||
+			(score == targetScore && level[n].size < level[target].size) {
+			target = n
+		}
+	}
+	if target >= 0 {
+		return target, ""
+	}
+	if acrossBoundary == len(level[k].neighbors) {
+		return -1, fmt.Sprintf("all %d neighbors are across a hard admin-1 boundary", acrossBoundary)
+	}
+	blocked := []string{}
+	if acrossBoundary > 0 {
+		blocked = append(blocked, fmt.Sprintf("%d are across a hard admin-1 boundary", acrossBoundary))
+	}
+	blocked = append(blocked, fmt.Sprintf("%d would exceed maxPopulation", tooPopulated), fmt.Sprintf("%d would exceed maxRegionSize", tooLarge))
+	if tooHeavy > 0 {
+		blocked = append(blocked, fmt.Sprintf("%d would exceed a weight maximum", tooHeavy))
+	}
+	if acrossBoundary > 0 || tooHeavy > 0 {
+		return -1, fmt.Sprintf("none of its %d neighbors can take it: %s", len(level[k].neighbors), strings.Join(blocked, ", "))
+	}
+	return -1, fmt.Sprintf("merging with any of its %d neighbors would break a maximum: %s", len(level[k].neighbors), strings.Join(blocked, ", "))
+}
+
+// enforceMinimums merges regions below MinPop, MinRegionSize or a weight
+// minimum into a neighbor until every region meets them or none of the rest
+// can be merged
+func enforceMinimums(level []growingRegion, options *project_types.LevelOptions, ordering Ordering) {
+	for changed := true; changed; {
+		changed = false
+		for _, k := range remaining(level, ordering) {
+			if level[k].merged || len(unmetConstraints(level[k].population, level[k].weights, level[k].size, options)) == 0 {
+				continue
+			}
+			if target, _ := mergeTarget(level, k, options, ordering); target >= 0 {
+				mergeRegions(level, target, k)
+				changed = true
+			}
+		}
+	}
+}
+
+// unmetRegions reports the regions of level that are still below the minimums
+func unmetRegions(level []growingRegion, options *project_types.LevelOptions, ordering Ordering) []project_types.UnmetRegion {
+	report := []project_types.UnmetRegion{}
+	for _, k := range remaining(level, Ordering{}) {
+		unmet := unmetConstraints(level[k].population, level[k].weights, level[k].size, options)
+		if len(unmet) == 0 {
+			continue
+		}
+		_, reason := mergeTarget(level, k, options, ordering)
+		report = append(report, project_types.UnmetRegion{
+			Region:     h3.ToString(level[k].index),
+			Population: level[k].population,
+			Weights:    level[k].weights,
+			Tiles:      len(level[k].tiles),
+			Unmet:      unmet,
+			Reason:     reason,
+		})
+	}
+	return report
+}
+
+// countryUnmet words the reasons of the unmet regions of a level generated
+// for country alone, where having no neighbors only means none in the country
+func countryUnmet(unmet []project_types.UnmetRegion, country string) []project_types.UnmetRegion {
+	if country == crossBorderCountry {
+		return unmet
+	}
+	for i := range unmet {
+		if unmet[i].Reason == isolatedReason {
+			unmet[i].Reason = fmt.Sprintf("isolated: no neighboring region in %s to merge with", country)
+		}
+	}
+	return unmet
+}
+
+// renameUnmet points a report at the ids regions ended up with in the stitched
+// level. A region's id during generation is always one of its tiles.
+func renameUnmet(report []project_types.UnmetRegion, level project_types.Level) {
+	if len(report) == 0 {
+		return
+	}
+	parents := level.TileParents()
+	for i := range report {
+		if id, ok := parents[h3.FromString(report[i].Region)]; ok {
+			report[i].Region = h3.ToString(level[id].Index)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Region < report[j].Region })
+}
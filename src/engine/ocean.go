@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	"github.com/mappichat/regions-engine/src/utils"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+const (
+	OceanUnassigned = "unassigned" // ocean tiles past the coast fill belong to nobody
+	OceanNearest    = "nearest"    // they join the nearest country
+	OceanWaters     = "waters"     // they join the territorial waters of the nearest country
+)
+
+// OceanPolicy decides what happens to ocean tiles within MaxDistance
+// kilometers of a country's tiles
+type OceanPolicy struct {
+	Mode        string
+	MaxDistance float64
+}
+
+func ParseOceanMode(mode string) (string, error) {
+	switch mode {
+	case OceanUnassigned, OceanNearest, OceanWaters:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown ocean policy %q, use %s, %s or %s", mode, OceanUnassigned, OceanNearest, OceanWaters)
+}
+
+// WatersCountry is the pseudo-country holding a country's territorial waters.
+// Being its own country keeps water and land in separate regions.
+func WatersCountry(country string) string {
+	return country + " (waters)"
+}
+
+// regionSizes returns how much every region of level counts against the size
+// limits: its tiles, less the ocean tiles when options exclude them
+func regionSizes(level project_types.Level, ocean map[h3.H3Index]bool, options *project_types.LevelOptions) []int {
+	sizes := make([]int, len(level))
+	for id, region := range level {
+		sizes[id] = len(region.Tiles)
+		if !options.ExcludeOceanFromSize || len(ocean) == 0 {
+			continue
+		}
+		for _, tile := range region.Tiles {
+			if ocean[tile] {
+				sizes[id]--
+			}
+		}
+	}
+	return sizes
+}
+
+// AssignOcean grows every country out over unassigned tiles, one ring at a
+// time, until tiles are farther than policy.MaxDistance from the country tile
+// they were reached from. Each ocean tile goes to the closest country tile of
+// its ring, or that country's waters. It returns the ocean tiles, sorted.
+func AssignOcean(h3ToCountry project_types.H3ToCountry, countryToH3 project_types.CountryToH3, policy OceanPolicy, ordering Ordering) []h3.H3Index {
+	if policy.Mode == OceanUnassigned || policy.MaxDistance <= 0 {
+		return nil
+	}
+	log.Printf("assigning ocean tiles up to %g km from a country\n", policy.MaxDistance)
+
+	source := map[h3.H3Index]h3.H3Index{} // ocean tile -> the country tile it is closest to
+	distance := func(tile h3.H3Index, from h3.H3Index) float64 {
+		a, b := h3.ToGeo(tile), h3.ToGeo(from)
+		return utils.Distance(a.Latitude, a.Longitude, b.Latitude, b.Longitude, "K")
+	}
+	// closer sources replace farther ones found in the same ring
+	reach := func(ring map[h3.H3Index]h3.H3Index, tile h3.H3Index, from h3.H3Index) {
+		if _, ok := h3ToCountry[tile]; ok {
+			return
+		}
+		if _, ok := source[tile]; ok {
+			return
+		}
+		d := distance(tile, from)
+		if d > policy.MaxDistance {
+			return
+		}
+		if current, ok := ring[tile]; ok {
+			if currentDistance := distance(tile, current); currentDistance < d || (currentDistance == d && current < from) {
+				return
+			}
+		}
+		ring[tile] = from
+	}
+
+	ring := map[h3.H3Index]h3.H3Index{}
+	for _, country := range orderedKeys(countryToH3, ordering) {
+		for _, tile := range countryToH3[country] {
+			for _, neighbor := range h3.KRing(tile, 1) {
+				reach(ring, neighbor, tile)
+			}
+		}
+	}
+	for len(ring) > 0 {
+		frontier := make([]h3.H3Index, 0, len(ring))
+		for tile, from := range ring {
+			source[tile] = from
+			frontier = append(frontier, tile)
+		}
+		sort.Slice(frontier, func(i, j int) bool { return frontier[i] < frontier[j] })
+		ring = map[h3.H3Index]h3.H3Index{}
+		for _, tile := range frontier {
+			for _, neighbor := range h3.KRing(tile, 1) {
+				reach(ring, neighbor, source[tile])
+			}
+		}
+	}
+
+	ocean := make([]h3.H3Index, 0, len(source))
+	for tile := range source {
+		ocean = append(ocean, tile)
+	}
+	sort.Slice(ocean, func(i, j int) bool { return ocean[i] < ocean[j] })
+	for _, tile := range ocean {
+		country := h3ToCountry[source[tile]]
+		if policy.Mode == OceanWaters {
+			country = WatersCountry(country)
+		}
+		h3ToCountry[tile] = country
+		countryToH3[country] = append(countryToH3[country], tile)
+	}
+	log.Printf("%d ocean tiles assigned\n", len(ocean))
+	return ocean
+}
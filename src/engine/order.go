@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// Ordering controls the order the engine visits countries and regions in.
+// Regions live in slices sorted by h3 index so they're always visited in a
+// fixed order, but countries are keyed by name in maps and Go randomizes map
+// iteration, so unless Deterministic is set two runs over the same input can
+// produce different regions. Seed changes how ties between otherwise equal
+// candidates are broken.
+type Ordering struct {
+	Deterministic bool
+	Seed          int64
+}
+
+// rank is the sort key of a region index, its own value unless a seed shuffles it
+func (o Ordering) rank(index h3.H3Index) uint64 {
+	if o.Seed == 0 {
+		return uint64(index)
+	}
+	// splitmix64 finalizer
+	z := uint64(index) ^ uint64(o.Seed)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// sortByIndex sorts ids by the rank of their region index
+func sortByIndex[T any](ids []T, indexOf func(T) h3.H3Index, ordering Ordering) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := indexOf(ids[i]), indexOf(ids[j])
+		ra, rb := ordering.rank(a), ordering.rank(b)
+		if ra != rb {
+			return ra < rb
+		}
+		return a < b
+	})
+}
+
+func orderedKeys[V any](m map[string]V, ordering Ordering) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if !ordering.Deterministic {
+		return keys
+	}
+	if ordering.Seed == 0 {
+		sort.Strings(keys)
+		return keys
+	}
+
+	type seededKey struct {
+		key  string
+		hash uint64
+	}
+	seedBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seedBytes, uint64(ordering.Seed))
+	seeded := make([]seededKey, len(keys))
+	for i, k := range keys {
+		hasher := fnv.New64a()
+		hasher.Write(seedBytes)
+		hasher.Write([]byte(k))
+		seeded[i] = seededKey{key: k, hash: hasher.Sum64()}
+	}
+	sort.Slice(seeded, func(i, j int) bool {
+		if seeded[i].hash != seeded[j].hash {
+			return seeded[i].hash < seeded[j].hash
+		}
+		return seeded[i].key < seeded[j].key
+	})
+	for i := range seeded {
+		keys[i] = seeded[i].key
+	}
+	return keys
+}
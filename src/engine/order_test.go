@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mappichat/regions-engine/src/fileio"
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// testCountries splits a patch of resolution 4 tiles into a grid of
+// countries of uneven sizes, some small enough to end up as a single region
+// that is merged into a neighboring country, and gives the tiles a random but
+// repeatable population
+func testCountries() (project_types.CountryToH3, project_types.PopMap) {
+	origin := h3.FromGeo(h3.GeoCoord{Latitude: 10, Longitude: 10}, 4)
+	tiles := h3.KRing(origin, 12)
+	random := rand.New(rand.NewSource(1))
+	countryToH3 := project_types.CountryToH3{}
+	popMap := project_types.PopMap{}
+	column := func(degrees float64) int {
+		return sort.SearchFloat64s([]float64{-1.5, -1.2, 0, 0.3, 1.5}, degrees)
+	}
+	for _, tile := range tiles {
+		center := h3.ToGeo(tile)
+		country := fmt.Sprintf("%c%d", 'a'+column(center.Longitude-10), column(center.Latitude-10))
+		countryToH3[country] = append(countryToH3[country], tile)
+		popMap[tile] = 0
+		if random.Intn(3) > 0 {
+			popMap[tile] = math.Round(random.ExpFloat64() * 100)
+		}
+	}
+	return countryToH3, popMap
+}
+
+func testOptions() []project_types.LevelOptions {
+	options := []project_types.LevelOptions{}
+	for i, size := range []int{7, 49, 343} {
+		options = append(options, project_types.LevelOptions{
+			MaxRegionSize:         size,
+			MaxPop:                float64(size) * 200,
+			MinPop:                float64(size) * 20,
+			DistanceExponent:      -2,
+			IslandDampeningPasses: 1,
+			SmallRegionMergeLimit: i + 1,
+			RefinementPasses:      2,
+			Weights:               map[string]project_types.WeightLimits{AreaWeight: {Max: float64(size) * 2000}},
+		})
+	}
+	return options
+}
+
+func quietLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestGenerateLevelDeterministic(t *testing.T) {
+	quietLog(t)
+	countryToH3, popMap := testCountries()
+	tiles := []h3.H3Index{}
+	for _, countryTiles := range countryToH3 {
+		tiles = append(tiles, countryTiles...)
+	}
+	options := testOptions()
+	for _, ordering := range []Ordering{{Deterministic: true}, {Deterministic: true, Seed: 42}} {
+		generate := func() project_types.Level {
+			level, err := GenerateLevel0(popMap, nil, tiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range options {
+				level, _ = GenerateLevel(level, &options[i], ordering, nil, nil)
+			}
+			return level
+		}
+		if first, second := generate(), generate(); !reflect.DeepEqual(first, second) {
+			t.Errorf("ordering %+v generated %d and %d regions that differ", ordering, len(first), len(second))
+		}
+	}
+}
+
+func TestGenerateAndWriteLevelsDeterministic(t *testing.T) {
+	quietLog(t)
+	countryToH3, popMap := testCountries()
+	h3ToCountry := project_types.H3ToCountry{}
+	for country, tiles := range countryToH3 {
+		for _, tile := range tiles {
+			h3ToCountry[tile] = country
+		}
+	}
+	weightMaps := project_types.WeightMaps{AreaWeight: TileAreas(h3ToCountry)}
+
+	generate := func() string {
+		dir := t.TempDir()
+		err := GenerateAndWriteLevels(popMap, countryToH3, dir, 4, testOptions(), GenerateOptions{
+			WeightMaps:      weightMaps,
+			CrossBorderFrom: 2,
+			Format:          fileio.LevelFormatBoth,
+			Ordering:        Ordering{Deterministic: true, Seed: 7},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	first, second := generate(), generate()
+
+	files, err := os.ReadDir(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("nothing was written")
+	}
+	for _, file := range files {
+		a, err := os.ReadFile(filepath.Join(first, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(second, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s differs between runs", file.Name())
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// balance summarizes how evenly population is spread over a level's regions
+type balance struct {
+	regions int
+	mean    float64
+	std     float64
+	min     float64
+	max     float64
+}
+
+func balanceOf(populations []float64) balance {
+	b := balance{regions: len(populations), min: math.Inf(1), max: math.Inf(-1)}
+	if len(populations) == 0 {
+		return balance{}
+	}
+	for _, pop := range populations {
+		b.mean += pop
+		b.min = math.Min(b.min, pop)
+		b.max = math.Max(b.max, pop)
+	}
+	b.mean /= float64(len(populations))
+	for _, pop := range populations {
+		b.std += (pop - b.mean) * (pop - b.mean)
+	}
+	b.std = math.Sqrt(b.std / float64(len(populations)))
+	return b
+}
+
+func (b balance) String() string {
+	return fmt.Sprintf("%d regions, population mean %.1f, std %.1f, min %.1f, max %.1f", b.regions, b.mean, b.std, b.min, b.max)
+}
+
+func levelBalance(level project_types.Level) balance {
+	populations := make([]float64, len(level))
+	for i, region := range level {
+		populations[i] = region.Population
+	}
+	return balanceOf(populations)
+}
+
+// refineLevel moves regions of prevLevel that sit on a boundary to the
+// neighboring region when that lowers the variance of level's objective,
+// population unless options combine weights. A move never leaves the region it
+// comes from disconnected, empty or below a minimum, never pushes the region it
+// goes to over a maximum, and never moves the region a parent took its index
+// from.
+// parents is the region each prevLevel region was grown into, before merging.
+func refineLevel(prevLevel project_types.Level, prevAdmins []string, prevSizes []int, level []growingRegion, parents []int, options *project_types.LevelOptions, ordering Ordering) {
+	assigned := make([]int, len(prevLevel))
+	for child, parent := range parents {
+		for level[parent].merged {
+			parent = level[parent].mergedInto
+		}
+		assigned[child] = parent
+	}
+
+	weighing := newWeighing(options)
+	ids := remaining(level, ordering)
+	populations := make([]float64, len(level))
+	scores := make([]float64, len(level))
+	weights := make([]project_types.Weights, len(level))
+	sizes := make([]int, len(level))
+	members := make([][]project_types.RegionID, len(level))
+	for child, parent := range assigned {
+		populations[parent] += prevLevel[child].Population
+		scores[parent] += weighing.score(prevLevel[child].Population, prevLevel[child].Weights)
+		weights[parent] = project_types.AddWeights(weights[parent], prevLevel[child].Weights)
+		sizes[parent] += prevSizes[child]
+		members[parent] = append(members[parent], project_types.RegionID(child))
+	}
+	before := make([]float64, len(ids))
+	for i, id := range ids {
+		before[i] = populations[id]
+	}
+
+	children := make([]project_types.RegionID, len(prevLevel))
+	for i := range children {
+		children[i] = project_types.RegionID(i)
+	}
+	if ordering.Seed != 0 {
+		sortByIndex(children, func(id project_types.RegionID) h3.H3Index { return prevLevel[id].Index }, ordering)
+	}
+
+	moved := 0
+	changed := make([]bool, len(level))
+	for pass := 0; pass < options.RefinementPasses; pass++ {
+		passMoves := 0
+		for _, child := range children {
+			from := assigned[child]
+			childPop := prevLevel[child].Population
+			childScore := weighing.score(childPop, prevLevel[child].Weights)
+			if childScore == 0 || len(members[from]) == 1 || prevLevel[child].Index == level[from].index {
+				continue
+			}
+
+			// moving x from a to b lowers a² + b² only when a - b > x
+			to := -1
+			bestGain := 0.0
+			for _, neighbor := range prevLevel[child].Neighbors {
+				candidate := assigned[neighbor]
+				if candidate == from || candidate == to {
+					continue
+				}
+				if populations[candidate]+childPop > options.MaxPop || sizes[candidate]+prevSizes[child] > options.MaxRegionSize {
+					continue
+				}
+				if weighing.exceeds(weights[candidate], prevLevel[child].Weights) {
+					continue
+				}
+				// balancing never adds admin-1 boundary crossings, hard or soft
+				if prevAdmins != nil && crossesAdmin(prevAdmins[child], level[candidate].admin) {
+					continue
+				}
+				gain := childScore * (scores[from] - scores[candidate] - childScore)
+				if gain > bestGain {
+					to = candidate
+					bestGain = gain
+				}
+			}
+			if populations[from]-childPop < options.MinPop || sizes[from]-prevSizes[child] < options.MinRegionSize {
+				continue
+			}
+			if weighing.underAfter(weights[from], prevLevel[child].Weights) {
+				continue
+			}
+			if to < 0 || !connectedWithout(prevLevel, assigned, members[from], child) {
+				continue
+			}
+
+			assigned[child] = to
+			populations[from] -= childPop
+			populations[to] += childPop
+			scores[from] -= childScore
+			scores[to] += childScore
+			weights[from] = subtractWeights(weights[from], prevLevel[child].Weights)
+			weights[to] = project_types.AddWeights(weights[to], prevLevel[child].Weights)
+			sizes[from] -= prevSizes[child]
+			sizes[to] += prevSizes[child]
+			members[from] = removeMember(members[from], child)
+			members[to] = append(members[to], child)
+			changed[from] = true
+			changed[to] = true
+			passMoves++
+		}
+		moved += passMoves
+		if passMoves == 0 {
+			break
+		}
+	}
+
+	after := make([]float64, len(ids))
+	for i, id := range ids {
+		after[i] = populations[id]
+	}
+	log.Printf("refinement moved %d regions: before %s; after %s\n", moved, balanceOf(before), balanceOf(after))
+	if moved == 0 {
+		return
+	}
+
+	// rebuild the regions that changed and every region's neighbors
+	for _, id := range ids {
+		level[id].neighbors = map[int]bool{}
+		if !changed[id] {
+			continue
+		}
+		level[id].population = populations[id]
+		level[id].weights = weights[id]
+		sort.Slice(members[id], func(a, b int) bool { return members[id][a] < members[id][b] })
+		level[id].tiles = make([]h3.H3Index, 0, sizes[id])
+		for _, child := range members[id] {
+			level[id].tiles = append(level[id].tiles, prevLevel[child].Tiles...)
+		}
+		level[id].centroid = calcCentroid(level[id].tiles)
+	}
+	for child, parent := range assigned {
+		for _, neighbor := range prevLevel[child].Neighbors {
+			if other := assigned[neighbor]; other != parent {
+				level[parent].neighbors[other] = true
+			}
+		}
+	}
+}
+
+// connectedWithout reports whether a parent's other members still touch each
+// other once child is taken out
+func connectedWithout(prevLevel project_types.Level, assigned []int, members []project_types.RegionID, child project_types.RegionID) bool {
+	start := members[0]
+	if start == child {
+		start = members[1]
+	}
+	parent := assigned[child]
+	seen := map[project_types.RegionID]bool{start: true, child: true}
+	stack := []project_types.RegionID{start}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, neighbor := range prevLevel[current].Neighbors {
+			if !seen[neighbor] && assigned[neighbor] == parent {
+				seen[neighbor] = true
+				stack = append(stack, neighbor)
+			}
+		}
+	}
+	return len(seen) == len(members)
+}
+
+func removeMember(members []project_types.RegionID, child project_types.RegionID) []project_types.RegionID {
+	for i, member := range members {
+		if member == child {
+			return append(members[:i], members[i+1:]...)
+		}
+	}
+	return members
+}
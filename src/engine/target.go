@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"log"
+	"math"
+	"sync"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+const (
+	defaultTargetTolerance = 0.05
+	maxTargetSearchSteps   = 16
+)
+
+// generated is a country's level and the regions in it below the minimums
+type generated struct {
+	level project_types.Level
+	unmet []project_types.UnmetRegion
+}
+
+// levelPlan is what a level is generated with: the options of every country,
+// and the levels the target search already generated with them
+type levelPlan struct {
+	Options   project_types.LevelOptions            `json:"options"`
+	Countries map[string]project_types.LevelOptions `json:"countries"`
+	results   map[string]generated
+}
+
+func (p levelPlan) optionsOf(country string) *project_types.LevelOptions {
+	if options, ok := p.Countries[country]; ok {
+		return &options
+	}
+	return &p.Options
+}
+
+// generateCountries runs GenerateLevel for every country in countries
+func generateCountries(prevLevels map[string]project_types.Level, countries []string, options *project_types.LevelOptions, ordering Ordering, h3ToAdmin project_types.H3ToAdmin, ocean map[h3.H3Index]bool, processes int) map[string]generated {
+	results := make(map[string]generated, len(countries))
+	wg := sync.WaitGroup{}
+	guard := make(chan struct{}, processes)
+	mutex := sync.Mutex{}
+	for _, country := range countries {
+		wg.Add(1)
+		guard <- struct{}{}
+		go func(country string) {
+			level, unmet := GenerateLevel(prevLevels[country], options, ordering, h3ToAdmin, ocean)
+			mutex.Lock()
+			results[country] = generated{level: level, unmet: countryUnmet(unmet, country)}
+			mutex.Unlock()
+			wg.Done()
+			<-guard
+		}(country)
+	}
+	wg.Wait()
+	return results
+}
+
+// searchTarget scales MaxPop, MaxRegionSize and the weight maximums together
+// until countries add up to about target regions. Fewer regions come from larger limits, so the
+// scale is doubled or halved until the target is bracketed and then bisected.
+// It returns the closest options it found and the levels they produced.
+func searchTarget(prevLevels map[string]project_types.Level, countries []string, base project_types.LevelOptions, target int, ordering Ordering, h3ToAdmin project_types.H3ToAdmin, ocean map[h3.H3Index]bool, processes int) (project_types.LevelOptions, map[string]generated) {
+	tolerance := base.TargetTolerance
+	if tolerance <= 0 {
+		tolerance = defaultTargetTolerance
+	}
+	if base.MaxPop <= 0 || base.MaxRegionSize <= 0 {
+		population := 0.0
+		tiles := 0
+		for _, country := range countries {
+			population += project_types.LevelTotalPop(prevLevels[country])
+			tiles += project_types.LevelTotalTiles(prevLevels[country])
+		}
+		if base.MaxPop <= 0 {
+			base.MaxPop = math.Max(population/float64(target), 1)
+		}
+		if base.MaxRegionSize <= 0 {
+			base.MaxRegionSize = int(math.Max(math.Round(float64(tiles)/float64(target)), 1))
+		}
+	}
+	scaled := func(scale float64) project_types.LevelOptions {
+		options := base
+		options.MaxPop = base.MaxPop * scale
+		options.MaxRegionSize = int(math.Max(math.Round(float64(base.MaxRegionSize)*scale), 1))
+		options.Weights = scaledWeightLimits(base.Weights, scale)
+		return options
+	}
+
+	var best project_types.LevelOptions
+	var bestResults map[string]generated
+	bestMiss := math.MaxInt
+	low, high := 0.0, 0.0 // scales known to give too many and too few regions
+	scale := 1.0
+	for step := 0; step < maxTargetSearchSteps; step++ {
+		options := scaled(scale)
+		results := generateCountries(prevLevels, countries, &options, ordering, h3ToAdmin, ocean, processes)
+		count := 0
+		for _, result := range results {
+			count += len(result.level)
+		}
+		log.Printf("target %d regions: maxPopulation %.1f, maxRegionSize %d gave %d\n", target, options.MaxPop, options.MaxRegionSize, count)
+
+		miss := count - target
+		if miss < 0 {
+			miss = -miss
+		}
+		if miss < bestMiss {
+			best, bestResults, bestMiss = options, results, miss
+		}
+		if float64(miss) <= tolerance*float64(target) {
+			break
+		}
+
+		if count > target {
+			low = scale
+		} else {
+			high = scale
+		}
+		if high == 0 {
+			scale *= 2
+		} else if low == 0 {
+			scale /= 2
+		} else if high/low < 1.001 {
+			break
+		} else {
+			scale = math.Sqrt(low * high)
+		}
+	}
+	if float64(bestMiss) > tolerance*float64(target) {
+		log.Printf("could not get within %.0f%% of %d regions, closest was %d off\n", tolerance*100, target, bestMiss)
+	}
+	return best, bestResults
+}
+
+// planLevel works out the options each country of a level is generated with.
+// Without a target everything uses options as configured.
+func planLevel(prevLevels map[string]project_types.Level, options project_types.LevelOptions, ordering Ordering, h3ToAdmin project_types.H3ToAdmin, ocean map[h3.H3Index]bool, processes int) levelPlan {
+	plan := levelPlan{Options: options, Countries: map[string]project_types.LevelOptions{}, results: map[string]generated{}}
+
+	if _, ok := prevLevels[crossBorderCountry]; ok && len(options.CountryTargetRegionCounts) > 0 {
+		log.Printf("warning: countryTargetRegionCounts are ignored on levels that cross country borders\n")
+	}
+	rest := []string{}
+	restTarget := options.TargetRegionCount
+	for _, country := range orderedKeys(prevLevels, Ordering{Deterministic: true}) {
+		target, ok := options.CountryTargetRegionCounts[country]
+		if !ok || target <= 0 {
+			rest = append(rest, country)
+			continue
+		}
+		log.Printf("searching for options giving %s %d regions\n", country, target)
+		countryOptions, results := searchTarget(prevLevels, []string{country}, options, target, ordering, h3ToAdmin, ocean, processes)
+		plan.Countries[country] = countryOptions
+		plan.results[country] = results[country]
+		restTarget -= target
+	}
+
+	if options.TargetRegionCount <= 0 || len(rest) == 0 {
+		return plan
+	}
+	if restTarget <= 0 {
+		log.Printf("country targets use up all %d target regions, the remaining countries use the configured limits\n", options.TargetRegionCount)
+		return plan
+	}
+	log.Printf("searching for options giving %d countries %d regions\n", len(rest), restTarget)
+	var results map[string]generated
+	plan.Options, results = searchTarget(prevLevels, rest, options, restTarget, ordering, h3ToAdmin, ocean, processes)
+	for country, result := range results {
+		plan.results[country] = result
+	}
+	return plan
+}
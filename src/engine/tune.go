@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// h3Aperture is how many children every h3 cell has at the next resolution
+const h3Aperture = 7
+
+// TuneOptions derives options for levels levels where every region groups
+// about branching regions of the level below, so regions of level i cover
+// about branching^(i+1) tiles, which is used as MaxRegionSize. MaxPop assumes
+// every tile of a full region holds quantilePop, a high quantile of the
+// population of populated tiles, so dense areas hit it before MaxRegionSize and end up with
+// smaller regions.
+func TuneOptions(resolution int, levels int, branching float64, quantilePop float64) (project_types.EngineOptions, error) {
+	tiles, ok := project_types.ResolutionSizes[resolution]
+	if !ok {
+		return nil, fmt.Errorf("invalid resolution %d", resolution)
+	}
+	if levels < 1 {
+		return nil, errors.New("at least one level is needed")
+	}
+	if branching <= 1 {
+		return nil, errors.New("the branching factor has to be larger than 1")
+	}
+	if quantilePop <= 0 {
+		return nil, errors.New("the population quantile is 0, is the popmap empty?")
+	}
+	if top := math.Pow(branching, float64(levels)); top > float64(tiles) {
+		log.Printf("warning: %d levels with branching factor %g need %.0f tiles per top level region but resolution %d only has %d tiles\n", levels, branching, top, resolution, tiles)
+	}
+	if branching != h3Aperture {
+		log.Printf("branching factor %g: level regions are about %.2f h3 resolutions apart (h3 aperture is %d)\n", branching, math.Log(branching)/math.Log(h3Aperture), h3Aperture)
+	}
+
+	options := make(project_types.EngineOptions, levels)
+	for i := range options {
+		size := math.Round(math.Pow(branching, float64(i+1)))
+		options[i] = project_types.LevelOptions{
+			MaxRegionSize:         int(size),
+			MaxPop:                size * quantilePop,
+			DistanceExponent:      -2,
+			IslandDampeningPasses: i + 1,
+			SmallRegionMergeLimit: int(math.Max(1, math.Round(size/(2*branching)))),
+		}
+	}
+	return options, nil
+}
+
+// SampleLevels generates options' levels over a disk of about sampleSize
+// tiles around the most populated tile of popMap and logs how many regions
+// every level ends up with next to how many were expected.
+func SampleLevels(popMap project_types.PopMap, sampleSize int, branching float64, options project_types.EngineOptions) error {
+	center := h3.H3Index(0)
+	for tile, pop := range popMap {
+		if center == 0 || pop > popMap[center] || (pop == popMap[center] && tile < center) {
+			center = tile
+		}
+	}
+	if center == 0 {
+		return errors.New("popmap is empty")
+	}
+	radius := 0
+	for 3*radius*(radius+1)+1 < sampleSize {
+		radius++
+	}
+	sample := []h3.H3Index{}
+	for _, tile := range h3.KRing(center, radius) {
+		if _, ok := popMap[tile]; ok {
+			sample = append(sample, tile)
+		}
+	}
+	log.Printf("sampling %d tiles around %s\n", len(sample), h3.ToString(center))
+
+	level, err := GenerateLevel0(popMap, nil, sample)
+	if err != nil {
+		return err
+	}
+	ordering := Ordering{Deterministic: true}
+	for i := range options {
+		var unmet []project_types.UnmetRegion
+		level, unmet = GenerateLevel(level, &options[i], ordering, nil, nil)
+		expected := float64(len(sample)) / math.Pow(branching, float64(i+1))
+		log.Printf("level %d: %d regions, expected about %.1f; %s\n", i, len(level), expected, levelBalance(level))
+		if len(unmet) > 0 {
+			log.Printf("level %d: %d regions below minPopulation or minRegionSize\n", i, len(unmet))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+)
+
+// ConfigErrors lists everything wrong with a config so it can be fixed in one go
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return fmt.Sprintf("config has %d problem(s):\n  %s", len(e), strings.Join(e, "\n  "))
+}
+
+// ValidateOptions checks options for values that would generate degenerate
+// levels at resolution. Limits may be 0 on levels with a target region count,
+// the search fills them in. crossBorderFrom is the first level generated
+// across country borders, or -1 if every level stays inside its country.
+func ValidateOptions(options project_types.EngineOptions, resolution int, crossBorderFrom int) error {
+	problems := ConfigErrors{}
+	add := func(level int, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("level %d: ", level)+fmt.Sprintf(format, args...))
+	}
+
+	if _, ok := project_types.ResolutionSizes[resolution]; !ok {
+		return ConfigErrors{fmt.Sprintf("resolution %d is not a valid h3 resolution (0-15)", resolution)}
+	}
+	// the tiles under one of the planet's 122 h3 base cells, each about 4.2
+	// million km2. A level of regions that size groups countries into
+	// continents, so one more level can still group those but nothing above
+	// that has anything left to group.
+	baseCellTiles := int(math.Pow(h3Aperture, float64(resolution)))
+	if len(options) == 0 {
+		return ConfigErrors{"no levels configured, the config must be a non-empty array of level options"}
+	}
+
+	for i, o := range options {
+		searched := o.TargetRegionCount > 0 || len(o.CountryTargetRegionCounts) > 0
+		if o.MaxRegionSize < 1 && !(searched && o.MaxRegionSize == 0) {
+			add(i, "maxRegionSize is %d, it must be at least 1 (or 0 with a targetRegionCount)", o.MaxRegionSize)
+		}
+		if o.MaxPop <= 0 && !(searched && o.MaxPop == 0) {
+			add(i, "maxPopulation is %g, it must be positive (or 0 with a targetRegionCount)", o.MaxPop)
+		}
+		if o.DistanceExponent > 0 {
+			add(i, "distanceExponent is %g, positive values make regions grow towards their farthest neighbors; use a negative value such as -2", o.DistanceExponent)
+		}
+		if o.IslandDampeningPasses < 0 {
+			add(i, "islandDampeningPasses is %d, it can't be negative", o.IslandDampeningPasses)
+		}
+		if o.SmallRegionMergeLimit < 0 {
+			add(i, "smallRegionMergeLimit is %d, it can't be negative", o.SmallRegionMergeLimit)
+		} else if o.MaxRegionSize > 0 && o.SmallRegionMergeLimit >= o.MaxRegionSize {
+			add(i, "smallRegionMergeLimit %d is not smaller than maxRegionSize %d, every region would be merged", o.SmallRegionMergeLimit, o.MaxRegionSize)
+		}
+		if o.RefinementPasses < 0 {
+			add(i, "refinementPasses is %d, it can't be negative", o.RefinementPasses)
+		}
+		if o.MinPop < 0 {
+			add(i, "minPopulation is %g, it can't be negative", o.MinPop)
+		} else if o.MaxPop > 0 && o.MinPop > o.MaxPop {
+			add(i, "minPopulation %g is larger than maxPopulation %g", o.MinPop, o.MaxPop)
+		}
+		if o.MinRegionSize < 0 {
+			add(i, "minRegionSize is %d, it can't be negative", o.MinRegionSize)
+		} else if o.MaxRegionSize > 0 && o.MinRegionSize > o.MaxRegionSize {
+			add(i, "minRegionSize %d is larger than maxRegionSize %d", o.MinRegionSize, o.MaxRegionSize)
+		}
+		if o.TargetRegionCount < 0 {
+			add(i, "targetRegionCount is %d, it can't be negative", o.TargetRegionCount)
+		}
+		for _, country := range orderedKeys(o.CountryTargetRegionCounts, Ordering{Deterministic: true}) {
+			if target := o.CountryTargetRegionCounts[country]; target < 1 {
+				add(i, "countryTargetRegionCounts[%q] is %d, it must be at least 1", country, target)
+			}
+		}
+		if crossBorderFrom >= 0 && i >= crossBorderFrom && len(o.CountryTargetRegionCounts) > 0 {
+			add(i, "countryTargetRegionCounts is set but levels from %d on cross country borders, so there are no countries to target; use targetRegionCount", crossBorderFrom)
+		}
+		if o.TargetTolerance < 0 || o.TargetTolerance >= 1 {
+			add(i, "targetTolerance is %g, it must be a fraction between 0 and 1", o.TargetTolerance)
+		}
+		if o.AdminBoundary != "" && o.AdminBoundary != adminHard && o.AdminBoundary != adminSoft {
+			add(i, "adminBoundary is %q, it must be %q, %q or empty", o.AdminBoundary, adminHard, adminSoft)
+		}
+		if o.AdminCrossingPenalty != 0 && o.AdminCrossingPenalty < 1 {
+			add(i, "adminCrossingPenalty is %g, it must be at least 1", o.AdminCrossingPenalty)
+		} else if o.AdminCrossingPenalty != 0 && o.AdminBoundary != adminSoft {
+			add(i, "adminCrossingPenalty is set but adminBoundary is %q, it only applies to %q", o.AdminBoundary, adminSoft)
+		}
+		for _, name := range orderedKeys(o.Weights, Ordering{Deterministic: true}) {
+			limits := o.Weights[name]
+			if name == "" || name == project_types.PopulationWeight {
+				add(i, "weights[%q] is not a weight name, population is limited by maxPopulation and minPopulation", name)
+			} else if limits.Max < 0 || limits.Min < 0 {
+				add(i, "weights[%q] has max %g and min %g, they can't be negative", name, limits.Max, limits.Min)
+			} else if limits.Max > 0 && limits.Min > limits.Max {
+				add(i, "weights[%q] min %g is larger than its max %g", name, limits.Min, limits.Max)
+			}
+		}
+		positive := false
+		for _, name := range orderedKeys(o.Objective, Ordering{Deterministic: true}) {
+			if coefficient := o.Objective[name]; coefficient < 0 {
+				add(i, "objective[%q] is %g, coefficients can't be negative", name, coefficient)
+			} else if coefficient > 0 {
+				positive = true
+			}
+		}
+		if len(o.Objective) > 0 && !positive {
+			add(i, "objective has no positive coefficient, leave it out to balance population alone")
+		}
+
+		if i == 0 {
+			continue
+		}
+		prev := options[i-1]
+		if o.MaxRegionSize > 0 && o.MaxRegionSize < prev.MaxRegionSize {
+			add(i, "maxRegionSize %d is smaller than level %d's %d, limits can't shrink between levels", o.MaxRegionSize, i-1, prev.MaxRegionSize)
+		}
+		if o.MaxPop > 0 && o.MaxPop < prev.MaxPop {
+			add(i, "maxPopulation %g is smaller than level %d's %g, limits can't shrink between levels", o.MaxPop, i-1, prev.MaxPop)
+		}
+		for _, name := range orderedKeys(o.Weights, Ordering{Deterministic: true}) {
+			if max, prevMax := o.Weights[name].Max, prev.Weights[name].Max; max > 0 && max < prevMax {
+				add(i, "weights[%q] max %g is smaller than level %d's %g, limits can't shrink between levels", name, max, i-1, prevMax)
+			}
+		}
+		if o.TargetRegionCount > 0 && prev.TargetRegionCount > 0 && o.TargetRegionCount > prev.TargetRegionCount {
+			add(i, "targetRegionCount %d is larger than level %d's %d, levels can only group regions together", o.TargetRegionCount, i-1, prev.TargetRegionCount)
+		}
+		if prev.MaxRegionSize > baseCellTiles && prev.TargetRegionCount == 0 {
+			add(i, "level %d's maxRegionSize %d is already larger than an h3 base cell (%d tiles at resolution %d), so this level would group continents; use fewer levels or a finer resolution", i-1, prev.MaxRegionSize, baseCellTiles, resolution)
+		}
+		if o.MaxRegionSize >= prev.MaxRegionSize && o.MaxRegionSize < 2*prev.MaxRegionSize && o.MaxPop >= prev.MaxPop && o.MaxPop < 2*prev.MaxPop {
+			add(i, "maxRegionSize %d and maxPopulation %g are less than twice level %d's %d and %g, so its regions can't hold two full regions of level %d and this level mostly repeats it; space the limits further apart or use fewer levels", o.MaxRegionSize, o.MaxPop, i-1, prev.MaxRegionSize, prev.MaxPop, i-1)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
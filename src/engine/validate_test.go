@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	"github.com/mappichat/regions-engine/src/utils"
+)
+
+func TestValidateDefaultOptions(t *testing.T) {
+	for resolution, options := range utils.DefaultOptions {
+		if err := ValidateOptions(options, resolution, -1); err != nil {
+			t.Errorf("default options of resolution %d: %s", resolution, err)
+		}
+	}
+}
+
+func TestValidateLevelDepth(t *testing.T) {
+	level := func(size int, pop float64) project_types.LevelOptions {
+		return project_types.LevelOptions{MaxRegionSize: size, MaxPop: pop, DistanceExponent: -2}
+	}
+	cases := map[string]struct {
+		options    project_types.EngineOptions
+		resolution int
+		problem    string
+	}{
+		"fits": {
+			options:    project_types.EngineOptions{level(7, 1e3), level(49, 1e4), level(343, 1e5)},
+			resolution: 2,
+		},
+		"too deep": {
+			options:    project_types.EngineOptions{level(7, 1e3), level(49, 1e4), level(343, 1e5), level(2401, 1e6)},
+			resolution: 2,
+			problem:    "level 3: level 2's maxRegionSize 343 is already larger than an h3 base cell",
+		},
+		"too shallow": {
+			options:    project_types.EngineOptions{level(7, 1e3), level(10, 1.5e3), level(70, 1e4)},
+			resolution: 5,
+			problem:    "level 1: maxRegionSize 10 and maxPopulation 1500 are less than twice level 0's",
+		},
+		"population grows": {
+			options:    project_types.EngineOptions{level(1000, 1e3), level(1000, 1e4), level(1000, 1e5)},
+			resolution: 5,
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateOptions(c.options, c.resolution, -1)
+			if c.problem == "" && err != nil {
+				t.Fatalf("got %s", err)
+			}
+			if c.problem != "" && (err == nil || !strings.Contains(err.Error(), c.problem)) {
+				t.Fatalf("got %v, want a problem containing %q", err, c.problem)
+			}
+		})
+	}
+}
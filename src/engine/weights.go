@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// AreaWeight is the weight TileAreas fills in without a popmap
+const AreaWeight = "area"
+
+type weightLimit struct {
+	name string
+	project_types.WeightLimits
+}
+
+type weightTerm struct {
+	name        string
+	coefficient float64
+}
+
+// weighing holds options' weight limits and objective sorted by name, so sums
+// come out the same on every run
+type weighing struct {
+	limits    []weightLimit
+	objective []weightTerm // empty when the objective is population alone
+}
+
+func newWeighing(options *project_types.LevelOptions) weighing {
+	w := weighing{}
+	for _, name := range orderedKeys(options.Weights, Ordering{Deterministic: true}) {
+		w.limits = append(w.limits, weightLimit{name, options.Weights[name]})
+	}
+	for _, name := range orderedKeys(options.Objective, Ordering{Deterministic: true}) {
+		w.objective = append(w.objective, weightTerm{name, options.Objective[name]})
+	}
+	return w
+}
+
+// score is what a region with population and weights counts for when
+// balancing regions
+func (w weighing) score(population float64, weights project_types.Weights) float64 {
+	if len(w.objective) == 0 {
+		return population
+	}
+	score := 0.0
+	for _, term := range w.objective {
+		if term.name == project_types.PopulationWeight {
+			score += term.coefficient * population
+		} else {
+			score += term.coefficient * weights.Get(term.name)
+		}
+	}
+	return score
+}
+
+// exceeds reports whether regions weighing a and b together go over a maximum
+func (w weighing) exceeds(a project_types.Weights, b project_types.Weights) bool {
+	for _, limit := range w.limits {
+		if limit.Max > 0 && a.Get(limit.name)+b.Get(limit.name) > limit.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// underAfter reports whether a region weighing a drops below a minimum once b
+// is taken out of it
+func (w weighing) underAfter(a project_types.Weights, b project_types.Weights) bool {
+	for _, limit := range w.limits {
+		if limit.Min > 0 && a.Get(limit.name)-b.Get(limit.name) < limit.Min {
+			return true
+		}
+	}
+	return false
+}
+
+// unmet lists the weight minimums a region weighing weights breaks
+func (w weighing) unmet(weights project_types.Weights) []string {
+	unmet := []string{}
+	for _, limit := range w.limits {
+		if limit.Min > 0 && weights.Get(limit.name) < limit.Min {
+			unmet = append(unmet, fmt.Sprintf("weights.%s.min", limit.name))
+		}
+	}
+	return unmet
+}
+
+// hasMinimums reports whether options set any minimum regions are held to
+func hasMinimums(options *project_types.LevelOptions) bool {
+	if options.MinPop > 0 || options.MinRegionSize > 0 {
+		return true
+	}
+	for _, limits := range options.Weights {
+		if limits.Min > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func subtractWeights(a project_types.Weights, b project_types.Weights) project_types.Weights {
+	for _, weight := range b {
+		a = a.Add(weight.Name, -weight.Value)
+	}
+	return a
+}
+
+// WeightNames lists the weights options refer to, sorted
+func WeightNames(options project_types.EngineOptions) []string {
+	names := map[string]bool{}
+	for _, o := range options {
+		for name := range o.Weights {
+			names[name] = true
+		}
+		for name := range o.Objective {
+			if name != project_types.PopulationWeight {
+				names[name] = true
+			}
+		}
+	}
+	return orderedKeys(names, Ordering{Deterministic: true})
+}
+
+// TileAreas is the area of every tile in h3ToCountry in square kilometers
+func TileAreas(h3ToCountry project_types.H3ToCountry) project_types.PopMap {
+	areas := make(project_types.PopMap, len(h3ToCountry))
+	for tile := range h3ToCountry {
+		areas[tile] = h3.CellAreaKm2(tile)
+	}
+	return areas
+}
+
+// tileWeights collects the weights of tiles from weightMaps into one block
+// indexed like the tiles, so the weights of tile i are the ith slice of the
+// result. It is nil without weights.
+func tileWeights(weightMaps project_types.WeightMaps, tiles []h3.H3Index) []project_types.Weights {
+	names := weightNamesOf(weightMaps)
+	if len(names) == 0 {
+		return nil
+	}
+	block := make(project_types.Weights, len(tiles)*len(names))
+	weights := make([]project_types.Weights, len(tiles))
+	for i, tile := range tiles {
+		start, end := i*len(names), (i+1)*len(names)
+		for j, name := range names {
+			block[start+j] = project_types.Weight{Name: name, Value: weightMaps[name][tile]}
+		}
+		// capped so adding to one tile's weights can't spill into the next
+		weights[i] = block[start:end:end]
+	}
+	return weights
+}
+
+// scaledWeightLimits multiplies every maximum of limits by scale
+func scaledWeightLimits(limits map[string]project_types.WeightLimits, scale float64) map[string]project_types.WeightLimits {
+	if limits == nil {
+		return nil
+	}
+	scaled := make(map[string]project_types.WeightLimits, len(limits))
+	for name, limit := range limits {
+		limit.Max *= scale
+		scaled[name] = limit
+	}
+	return scaled
+}
+
+// weightNamesOf lists the names of weightMaps sorted, nil without weights
+func weightNamesOf(weightMaps project_types.WeightMaps) []string {
+	if len(weightMaps) == 0 {
+		return nil
+	}
+	return orderedKeys(weightMaps, Ordering{Deterministic: true})
+}
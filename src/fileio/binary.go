@@ -0,0 +1,303 @@
+package fileio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// Binary level files (level{N}.bin) hold a level and its parents map in one
+// file. Everything is little endian and maps directly onto project_types.Level:
+//
+//	header     magic "RGNL", version uint16, flags uint16,
+//	           region count uint32, tile count uint64, neighbor count uint64
+//	regions    per region: index uint64, population float64,
+//	           centroid latitude float64, centroid longitude float64
+//	tiles      region count + 1 uint64 offsets, then tile count uint64 h3 indexes
+//	neighbors  region count + 1 uint64 offsets, then neighbor count uint32
+//	           positions in the region table
+//	checksum   crc32 (IEEE) of everything before it
+//
+// Levels whose regions carry weights are version 2 and set the weights
+// flag, which adds
+//
+//	names      after the header: name count uint32, then per name its
+//	           length uint16 and bytes, sorted
+//	weights    after the neighbors: region count * name count float64, by
+//	           region then name
+//
+// Levels without weights stay version 1, which readers from before weights
+// can still read.
+//
+// Regions are sorted by index, so neighbor positions are RegionIDs. The
+// parents map isn't stored because every tile's parent is the region whose
+// tile list contains it.
+const (
+	binaryMagic          = "RGNL"
+	binaryVersion        = 1
+	binaryWeightsVersion = 2 // first version with the weights flag
+	binaryFlagWeights    = 1
+	headerSize           = 4 + 2 + 2 + 4 + 8 + 8
+	regionSize           = 8 * 4
+)
+
+func IsBinaryLevel(data []byte) bool {
+	return len(data) >= len(binaryMagic) && string(data[:len(binaryMagic)]) == binaryMagic
+}
+
+func EncodeLevelBinary(level project_types.Level, w io.Writer) error {
+	tileCount := 0
+	neighborCount := 0
+	names := map[string]bool{}
+	for i, region := range level {
+		if i > 0 && level[i-1].Index >= region.Index {
+			return errors.New("level regions must be sorted by index")
+		}
+		tileCount += len(region.Tiles)
+		neighborCount += len(region.Neighbors)
+		for _, weight := range region.Weights {
+			names[weight.Name] = true
+		}
+	}
+	weightNames := make([]string, 0, len(names))
+	for name := range names {
+		if len(name) > math.MaxUint16 {
+			return fmt.Errorf("weight name %.20q... is too long", name)
+		}
+		weightNames = append(weightNames, name)
+	}
+	sort.Strings(weightNames)
+	version, flags := uint16(binaryVersion), uint16(0)
+	if len(weightNames) > 0 {
+		version = binaryWeightsVersion
+		flags |= binaryFlagWeights
+	}
+
+	checksum := crc32.NewIEEE()
+	out := bufio.NewWriter(io.MultiWriter(w, checksum))
+	put := func(v any) error {
+		return binary.Write(out, binary.LittleEndian, v)
+	}
+
+	if _, err := out.WriteString(binaryMagic); err != nil {
+		return err
+	}
+	for _, v := range []any{version, flags, uint32(len(level)), uint64(tileCount), uint64(neighborCount)} {
+		if err := put(v); err != nil {
+			return err
+		}
+	}
+	if flags&binaryFlagWeights != 0 {
+		if err := put(uint32(len(weightNames))); err != nil {
+			return err
+		}
+		for _, name := range weightNames {
+			if err := put(uint16(len(name))); err != nil {
+				return err
+			}
+			if _, err := out.WriteString(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, region := range level {
+		for _, v := range []any{uint64(region.Index), region.Population, region.Centroid.Latitude, region.Centroid.Longitude} {
+			if err := put(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	offset := uint64(0)
+	for _, region := range level {
+		if err := put(offset); err != nil {
+			return err
+		}
+		offset += uint64(len(region.Tiles))
+	}
+	if err := put(offset); err != nil {
+		return err
+	}
+	for _, region := range level {
+		if err := put(region.Tiles); err != nil {
+			return err
+		}
+	}
+
+	offset = 0
+	for _, region := range level {
+		if err := put(offset); err != nil {
+			return err
+		}
+		offset += uint64(len(region.Neighbors))
+	}
+	if err := put(offset); err != nil {
+		return err
+	}
+	for _, region := range level {
+		for _, neighbor := range region.Neighbors {
+			if int(neighbor) >= len(level) || neighbor < 0 {
+				return fmt.Errorf("region %s has unknown neighbor %d", h3.ToString(region.Index), neighbor)
+			}
+			if err := put(uint32(neighbor)); err != nil {
+				return err
+			}
+		}
+	}
+	if flags&binaryFlagWeights != 0 {
+		for _, region := range level {
+			for _, name := range weightNames {
+				if err := put(region.Weights.Get(name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, checksum.Sum32())
+}
+
+func DecodeLevelBinary(data []byte) (project_types.Level, error) {
+	if !IsBinaryLevel(data) {
+		return nil, errors.New("not a binary level file")
+	}
+	if len(data) < headerSize+4 {
+		return nil, errors.New("binary level file is truncated")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("binary level file checksum mismatch")
+	}
+
+	version := binary.LittleEndian.Uint16(body[4:])
+	if version != binaryVersion && version != binaryWeightsVersion {
+		return nil, fmt.Errorf("unsupported binary level version %d", version)
+	}
+	flags := binary.LittleEndian.Uint16(body[6:])
+	if flags&binaryFlagWeights != 0 && version < binaryWeightsVersion {
+		return nil, fmt.Errorf("binary level version %d can't carry weights", version)
+	}
+	regionCount := uint64(binary.LittleEndian.Uint32(body[8:]))
+	tileCount := binary.LittleEndian.Uint64(body[12:])
+	neighborCount := binary.LittleEndian.Uint64(body[20:])
+
+	namesSize := uint64(0)
+	weightNames := []string{}
+	if flags&binaryFlagWeights != 0 {
+		names := body[headerSize:]
+		if len(names) < 4 {
+			return nil, errors.New("binary level file is truncated")
+		}
+		count := binary.LittleEndian.Uint32(names)
+		namesSize = 4
+		for i := uint32(0); i < count; i++ {
+			if uint64(len(names)) < namesSize+2 {
+				return nil, errors.New("binary level file is truncated")
+			}
+			length := uint64(binary.LittleEndian.Uint16(names[namesSize:]))
+			if uint64(len(names)) < namesSize+2+length {
+				return nil, errors.New("binary level file is truncated")
+			}
+			name := string(names[namesSize+2 : namesSize+2+length])
+			if i > 0 && weightNames[i-1] >= name {
+				return nil, errors.New("binary level file weight names are not sorted")
+			}
+			weightNames = append(weightNames, name)
+			namesSize += 2 + length
+		}
+	}
+
+	// every count has to fit in the file on its own before they're added up,
+	// so a crafted header can't wrap the expected size around to the real one
+	size := uint64(len(body))
+	if regionCount > size/regionSize || tileCount > size/8 || neighborCount > size/4 ||
+		(len(weightNames) > 0 && regionCount > size/8/uint64(len(weightNames))) {
+		return nil, fmt.Errorf("binary level file has %d bytes, too few for %d regions, %d tiles and %d neighbors", size, regionCount, tileCount, neighborCount)
+	}
+	weightCount := regionCount * uint64(len(weightNames))
+	expected := headerSize + namesSize + regionCount*regionSize + (regionCount+1)*8 + tileCount*8 + (regionCount+1)*8 + neighborCount*4 + weightCount*8
+	if size != expected {
+		return nil, fmt.Errorf("binary level file has %d bytes, header describes %d", len(body), expected)
+	}
+
+	reader := bytes.NewReader(body[headerSize+namesSize:])
+	regionTable := make([]uint64, regionCount*4)
+	tileOffsets := make([]uint64, regionCount+1)
+	tiles := make([]h3.H3Index, tileCount)
+	neighborOffsets := make([]uint64, regionCount+1)
+	neighbors := make([]project_types.RegionID, neighborCount)
+	weightValues := make([]float64, weightCount)
+	for _, v := range []any{regionTable, tileOffsets, tiles, neighborOffsets, neighbors, weightValues} {
+		if err := binary.Read(reader, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	weights := make(project_types.Weights, weightCount)
+	for i := range weights {
+		weights[i] = project_types.Weight{Name: weightNames[i%len(weightNames)], Value: weightValues[i]}
+	}
+
+	level := make(project_types.Level, regionCount)
+	for i := uint64(0); i < regionCount; i++ {
+		index := h3.H3Index(regionTable[4*i])
+		if tileOffsets[i] > tileOffsets[i+1] || tileOffsets[i+1] > tileCount ||
+			neighborOffsets[i] > neighborOffsets[i+1] || neighborOffsets[i+1] > neighborCount {
+			return nil, fmt.Errorf("binary level file has invalid offsets for region %s", h3.ToString(index))
+		}
+		if i > 0 && level[i-1].Index >= index {
+			return nil, errors.New("binary level file regions are not sorted")
+		}
+		for _, neighbor := range neighbors[neighborOffsets[i]:neighborOffsets[i+1]] {
+			if neighbor < 0 || uint64(neighbor) >= regionCount {
+				return nil, fmt.Errorf("binary level file has invalid neighbor for region %s", h3.ToString(index))
+			}
+		}
+		// slices share the backing arrays read above
+		level[i] = project_types.Region{
+			Index:      index,
+			Population: math.Float64frombits(regionTable[4*i+1]),
+			Tiles:      tiles[tileOffsets[i]:tileOffsets[i+1]:tileOffsets[i+1]],
+			Neighbors:  neighbors[neighborOffsets[i]:neighborOffsets[i+1]:neighborOffsets[i+1]],
+			Centroid: h3.GeoCoord{
+				Latitude:  math.Float64frombits(regionTable[4*i+2]),
+				Longitude: math.Float64frombits(regionTable[4*i+3]),
+			},
+		}
+		if len(weightNames) > 0 {
+			start, end := i*uint64(len(weightNames)), (i+1)*uint64(len(weightNames))
+			level[i].Weights = weights[start:end:end]
+		}
+	}
+	return level, nil
+}
+
+func WriteLevelBinary(level project_types.Level, filePath string) error {
+	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if err := EncodeLevelBinary(level, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
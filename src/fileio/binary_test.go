@@ -0,0 +1,165 @@
+package fileio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// testLevel is three regions in a row, every tile carrying weights when
+// weighted is set
+func testLevel(weighted bool) project_types.Level {
+	origin := h3.FromGeo(h3.GeoCoord{Latitude: 48.85, Longitude: 2.35}, 5)
+	tiles := h3.KRing(origin, 2)
+	level := project_types.Level{}
+	for i := 0; i < 3; i++ {
+		region := project_types.Region{
+			Population: float64(100*i) + 0.5,
+			Tiles:      tiles[i*5 : i*5+5],
+			Neighbors:  []project_types.RegionID{},
+		}
+		region.Index = region.Tiles[0]
+		region.Centroid = h3.ToGeo(region.Index)
+		if weighted {
+			region.Weights = project_types.WeightsFromMap(map[string]float64{"area": 1.25 * float64(i+1), "dau": float64(7 * i)})
+		}
+		level = append(level, region)
+	}
+	level = project_types.SortLevel(level)
+	level[0].Neighbors = []project_types.RegionID{1}
+	level[1].Neighbors = []project_types.RegionID{0, 2}
+	level[2].Neighbors = []project_types.RegionID{1}
+	return level
+}
+
+func sameLevel(t *testing.T, got project_types.Level, want project_types.Level) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d regions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Index != w.Index || g.Population != w.Population || g.Centroid != w.Centroid {
+			t.Fatalf("region %d is %s %g %v, want %s %g %v", i, h3.ToString(g.Index), g.Population, g.Centroid, h3.ToString(w.Index), w.Population, w.Centroid)
+		}
+		if fmt.Sprint(g.Tiles) != fmt.Sprint(w.Tiles) {
+			t.Fatalf("region %d has tiles %v, want %v", i, g.Tiles, w.Tiles)
+		}
+		if fmt.Sprint(g.Neighbors) != fmt.Sprint(w.Neighbors) {
+			t.Fatalf("region %d has neighbors %v, want %v", i, g.Neighbors, w.Neighbors)
+		}
+		if fmt.Sprint(g.Weights) != fmt.Sprint(w.Weights) {
+			t.Fatalf("region %d has weights %v, want %v", i, g.Weights, w.Weights)
+		}
+	}
+}
+
+func TestLevelRoundTrip(t *testing.T) {
+	for _, weighted := range []bool{false, true} {
+		for _, format := range []LevelFormat{LevelFormatBinary, LevelFormatJson} {
+			t.Run(fmt.Sprintf("%s weighted %v", format, weighted), func(t *testing.T) {
+				level := testLevel(weighted)
+				dir := t.TempDir()
+				if err := WriteLevel(level, dir, 0, format); err != nil {
+					t.Fatal(err)
+				}
+				read, err := ReadLevelFromDir(dir, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sameLevel(t, read, level)
+			})
+		}
+	}
+}
+
+func TestBinaryLevelVersion(t *testing.T) {
+	for weighted, want := range map[bool]uint16{false: binaryVersion, true: binaryWeightsVersion} {
+		filePath := filepath.Join(t.TempDir(), "level0.bin")
+		if err := WriteLevelBinary(testLevel(weighted), filePath); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version := binary.LittleEndian.Uint16(data[4:]); version != want {
+			t.Errorf("weighted %v level has version %d, want %d", weighted, version, want)
+		}
+	}
+}
+
+func TestBinaryLevelCorruption(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "level0.bin")
+	if err := WriteLevelBinary(testLevel(true), filePath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rewrite the checksum so only the edit itself is wrong
+	resum := func(data []byte) []byte {
+		resummed := append([]byte{}, data...)
+		binary.LittleEndian.PutUint32(resummed[len(data)-4:], crc32.ChecksumIEEE(data[:len(data)-4]))
+		return resummed
+	}
+
+	cases := map[string]struct {
+		data []byte
+		err  string
+	}{
+		"flipped bit": {
+			data: func() []byte {
+				corrupted := append([]byte{}, data...)
+				corrupted[headerSize+10] ^= 1
+				return corrupted
+			}(),
+			err: "checksum mismatch",
+		},
+		"truncated": {
+			data: resum(data[:len(data)-12]),
+			err:  "header describes",
+		},
+		"wrapping tile count": {
+			data: func() []byte {
+				corrupted := append([]byte{}, data...)
+				// tileCount*8 overflows back to the size the file really has
+				tileCount := binary.LittleEndian.Uint64(corrupted[12:])
+				binary.LittleEndian.PutUint64(corrupted[12:], tileCount+1<<61)
+				return resum(corrupted)
+			}(),
+			err: "too few for",
+		},
+		"unknown version": {
+			data: func() []byte {
+				corrupted := append([]byte{}, data...)
+				binary.LittleEndian.PutUint16(corrupted[4:], 99)
+				return resum(corrupted)
+			}(),
+			err: "unsupported binary level version 99",
+		},
+		"weights in version 1": {
+			data: func() []byte {
+				corrupted := append([]byte{}, data...)
+				binary.LittleEndian.PutUint16(corrupted[4:], binaryVersion)
+				return resum(corrupted)
+			}(),
+			err: "can't carry weights",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := DecodeLevelBinary(c.data); err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got error %v, want one containing %q", err, c.err)
+			}
+		})
+	}
+}
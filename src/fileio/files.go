@@ -1,14 +1,18 @@
 package fileio
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
+	"os"
 	"path"
-	"path/filepath"
-	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -17,11 +21,25 @@ import (
 	h3 "github.com/uber/h3-go/v3"
 )
 
+// LoadOptions reads an engine config, rejecting fields LevelOptions doesn't
+// have so typos don't silently fall back to 0
 func LoadOptions(filePath string) (project_types.EngineOptions, error) {
-	options := project_types.EngineOptions{}
-	if err := utils.ReadJsonFile(filePath, &options); err != nil {
+	data, err := utils.ReadFileBytes(filePath)
+	if err != nil {
 		return nil, err
 	}
+	levels := []json.RawMessage{}
+	if err := json.Unmarshal(data, &levels); err != nil {
+		return nil, fmt.Errorf("config must be a json array of level options: %w", err)
+	}
+	options := make(project_types.EngineOptions, len(levels))
+	for i, level := range levels {
+		decoder := json.NewDecoder(bytes.NewReader(level))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&options[i]); err != nil {
+			return nil, fmt.Errorf("level %d: %w", i, err)
+		}
+	}
 	return options, nil
 }
 
@@ -36,9 +54,9 @@ func GenerateTestPopMap(resolution int) map[string]int {
 
 	for h := range utils.H3Tiles(resolution) {
 		if rand.Intn(10) == 0 {
-			popMap[h] = int(math.Round(rand.ExpFloat64() * 100))
+			popMap[h3.ToString(h)] = int(math.Round(rand.ExpFloat64() * 100))
 		} else {
-			popMap[h] = 0
+			popMap[h3.ToString(h)] = 0
 		}
 
 		i++
@@ -49,101 +67,111 @@ func GenerateTestPopMap(resolution int) map[string]int {
 	return popMap
 }
 
-func polygonToH3Polygon(polygon [][][]float64) (h3.GeoPolygon, error) {
-	if len(polygon) == 0 {
-		return h3.GeoPolygon{}, errors.New("polygon empty")
-	}
-	geoFence := []h3.GeoCoord{}
-	for _, coord := range polygon[0] {
-		geoFence = append(geoFence, h3.GeoCoord{
-			Latitude:  coord[0],
-			Longitude: coord[1],
-		})
-	}
-	holes := [][]h3.GeoCoord{}
-	for _, shape := range polygon[1:] {
-		hole := []h3.GeoCoord{}
-		for _, coord := range shape {
-			hole = append(hole, h3.GeoCoord{
-				Latitude:  coord[0],
-				Longitude: coord[1],
-			})
-		}
-		holes = append(holes, hole)
+// propertyString reads a GeoJSON property that should identify a feature.
+// Numeric codes such as ISO_N3 are accepted too.
+func propertyString(properties map[string]interface{}, key string) (string, bool) {
+	switch value := properties[key].(type) {
+	case string:
+		return value, value != ""
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
 	}
-	return h3.GeoPolygon{Geofence: geoFence, Holes: holes}, nil
+	return "", false
 }
 
-// filePath should point to a geojson file
-func ReadCountriesFile(filePath string) (project_types.CountryPolygons, error) {
+// placeholderID is what Natural Earth puts in the code properties of features
+// that have no code
+const placeholderID = "-99"
+
+// ReadAreasFile reads the polygons of every feature of a geojson file keyed by
+// the feature's idProperty, and their display names from nameProperty.
+// Without an idProperty, or where it holds a placeholder, the name doubles as
+// the id. Features sharing an id and name are merged into one area, features
+// sharing an id under different names are an error.
+func ReadAreasFile(filePath string, nameProperty string, idProperty string) (project_types.CountryPolygons, project_types.CountryNames, error) {
 	geojson := project_types.GeoJson{}
 	if err := utils.ReadJsonFile(filePath, &geojson); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if geojson.Type != "FeatureCollection" {
+		return nil, nil, fmt.Errorf("%s is a %q, expected a geojson FeatureCollection", filePath, geojson.Type)
+	}
+	if len(geojson.Features) == 0 {
+		return nil, nil, fmt.Errorf("%s has no features", filePath)
 	}
 
 	countries := project_types.CountryPolygons{}
-	for _, feature := range geojson.Features {
-		newCountry := []h3.GeoPolygon{}
-		geoType := strings.ToLower(feature.Geometry.Type)
-		if geoType == "polygon" {
-			polygon := [][][]float64{}
-			for _, v1 := range feature.Geometry.Coordinates {
-				a1 := [][]float64{}
-				for _, v2 := range v1 {
-					a2 := []float64{}
-					for _, v3 := range v2 {
-						a3 := v3.(float64)
-						a2 = append(a2, a3)
-					}
-					// need to flip coordinates because geojson does lng,lat instead of lat,lng
-					lng := a2[0]
-					a2[0] = a2[1]
-					a2[1] = lng
-					a1 = append(a1, a2)
-				}
-				polygon = append(polygon, a1)
-			}
-			geoPolygon, err := polygonToH3Polygon(polygon)
-			if err != nil {
-				return nil, err
+	names := project_types.CountryNames{}
+	features := map[string]int{}
+	for i, feature := range geojson.Features {
+		name, ok := propertyString(feature.Properties, nameProperty)
+		if !ok {
+			return nil, nil, fmt.Errorf("feature %d of %s has no %s property", i, filePath, nameProperty)
+		}
+		if feature.Geometry == nil {
+			log.Printf("warning: skipping feature %d (%s) of %s, it has no geometry\n", i, name, filePath)
+			continue
+		}
+		id := name
+		if idProperty != "" {
+			if id, ok = propertyString(feature.Properties, idProperty); !ok {
+				return nil, nil, fmt.Errorf("feature %d (%s) of %s has no %s property", i, name, filePath, idProperty)
 			}
-			newCountry = append(newCountry, geoPolygon)
-		} else if geoType == "multipolygon" {
-			multipolygon := [][][][]float64{}
-			for _, v1 := range feature.Geometry.Coordinates {
-				a1 := [][][]float64{}
-				for _, v2 := range v1 {
-					a2 := [][]float64{}
-					for _, v3 := range v2 {
-						// need to flip coordinates because geojson does lng,lat instead of lat,lng
-						s := reflect.ValueOf(v3)
-						a3 := []float64{s.Index(1).Interface().(float64), s.Index(0).Interface().(float64)}
-						a2 = append(a2, a3)
-					}
-					a1 = append(a1, a2)
-				}
-				multipolygon = append(multipolygon, a1)
+			if id == placeholderID {
+				log.Printf("warning: feature %d (%s) of %s has %s %s, using its name as the id\n", i, name, filePath, idProperty, id)
+				id = name
 			}
-			for _, polygon := range multipolygon {
-				geoPolygon, err := polygonToH3Polygon(polygon)
-				if err != nil {
-					return nil, err
-				}
-				newCountry = append(newCountry, geoPolygon)
-			}
-		} else {
-			return nil, fmt.Errorf("unsupported geometry type %s", geoType)
 		}
-		countries[feature.Properties.Name] = newCountry
+		if previous, ok := names[id]; ok && previous != name {
+			return nil, nil, fmt.Errorf("%q and %q in %s share %s %q, give them distinct ids or use another id property", previous, name, filePath, idProperty, id)
+		}
+		names[id] = name
+		features[id]++
+
+		newCountry, err := geometryPolygons(feature.Geometry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("feature %d (%s) of %s: %w", i, name, filePath, err)
+		}
+		countries[id] = append(countries[id], newCountry...)
+	}
+
+	// duplicates used to overwrite each other, so say what happened to them
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
 	}
-	return countries, nil
+	sort.Strings(ids)
+	idKey := idProperty
+	if idKey == "" {
+		idKey = nameProperty
+	}
+	byName := map[string][]string{}
+	for _, id := range ids {
+		if features[id] > 1 {
+			log.Printf("warning: %d features of %s share %s %q, their polygons are merged\n", features[id], filePath, idKey, id)
+		}
+		byName[names[id]] = append(byName[names[id]], id)
+	}
+	for _, id := range ids {
+		if shared := byName[names[id]]; len(shared) > 1 && shared[0] == id {
+			log.Printf("warning: %s all have the name %q\n", strings.Join(shared, ", "), names[id])
+		}
+	}
+	return countries, names, nil
 }
 
+// LoadPopMapJson reads a popmap and fills in every tile at resolution it leaves out
 func LoadPopMapJson(filePath string, resolution int) (project_types.PopMap, error) {
 	popmap := project_types.PopMap{}
 	if err := utils.ReadJsonFile(filePath, &popmap); err != nil {
 		return nil, err
 	}
+	if popmapResolution, err := PopMapResolution(popmap); err == nil && popmapResolution != resolution {
+		return nil, fmt.Errorf("%s has resolution %d, not %d", filePath, popmapResolution, resolution)
+	} else if err != nil && len(popmap) > 0 {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
 
 	i := 0
 	for h := range utils.H3Tiles(resolution) {
@@ -159,6 +187,24 @@ func LoadPopMapJson(filePath string, resolution int) (project_types.PopMap, erro
 	return popmap, nil
 }
 
+// LoadWeightMap reads a popmap holding a weight other than population, such as
+// daily active users. Unlike LoadPopMapJson it leaves missing tiles out.
+func LoadWeightMap(filePath string, resolution int) (project_types.PopMap, error) {
+	weightMap := project_types.PopMap{}
+	if err := utils.ReadJsonFile(filePath, &weightMap); err != nil {
+		return nil, err
+	}
+	if len(weightMap) == 0 {
+		return weightMap, nil
+	}
+	if weightResolution, err := PopMapResolution(weightMap); err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	} else if weightResolution != resolution {
+		return nil, fmt.Errorf("%s has resolution %d, not %d", filePath, weightResolution, resolution)
+	}
+	return weightMap, nil
+}
+
 func PopMapStats(popmap project_types.PopMap) (float64, float64) {
 	size := len(popmap)
 	mean := 0.0
@@ -175,46 +221,142 @@ func PopMapStats(popmap project_types.PopMap) (float64, float64) {
 	return mean, stddev
 }
 
-func ReadLevel(filePath string) (map[string]project_types.Region, error) {
-	level := project_types.Level{}
-	if err := utils.ReadJsonFile(filePath, &level); err != nil {
+// PopMapQuantiles returns the population of populated tiles at each quantile
+// in quantiles (0 to 1). Empty tiles are left out, most of the world is ocean.
+func PopMapQuantiles(popmap project_types.PopMap, quantiles []float64) []float64 {
+	pops := []float64{}
+	for _, pop := range popmap {
+		if pop > 0 {
+			pops = append(pops, pop)
+		}
+	}
+	sort.Float64s(pops)
+	values := make([]float64, len(quantiles))
+	if len(pops) == 0 {
+		return values
+	}
+	for i, q := range quantiles {
+		position := int(math.Round(q * float64(len(pops)-1)))
+		if position < 0 {
+			position = 0
+		} else if position >= len(pops) {
+			position = len(pops) - 1
+		}
+		values[i] = pops[position]
+	}
+	return values
+}
+
+// ReadLevel reads a json or binary level file, detecting the format from its contents
+func ReadLevel(filePath string) (project_types.Level, error) {
+	data, err := utils.ReadFileBytes(filePath)
+	if err != nil {
 		return nil, err
 	}
-	return level, nil
+	if IsBinaryLevel(data) {
+		return DecodeLevelBinary(data)
+	}
+	levelJson := project_types.LevelJson{}
+	if err := json.Unmarshal(data, &levelJson); err != nil {
+		return nil, err
+	}
+	return project_types.LevelFromJson(levelJson)
+}
+
+type LevelFormat string
+
+const (
+	LevelFormatBinary LevelFormat = "binary"
+	LevelFormatJson   LevelFormat = "json"
+	LevelFormatBoth   LevelFormat = "both"
+)
+
+func ParseLevelFormat(format string) (LevelFormat, error) {
+	switch LevelFormat(format) {
+	case LevelFormatBinary, LevelFormatJson, LevelFormatBoth:
+		return LevelFormat(format), nil
+	}
+	return "", fmt.Errorf("unknown level format %q, use binary, json or both", format)
+}
+
+// WriteLevel writes level{N}.bin and/or level{N}.json + parents{N}.json
+func WriteLevel(level project_types.Level, dirName string, levelIndex int, format LevelFormat) error {
+	if format == LevelFormatBinary || format == LevelFormatBoth {
+		if err := WriteLevelBinary(level, path.Join(dirName, fmt.Sprintf("level%d.bin", levelIndex))); err != nil {
+			return err
+		}
+	}
+	if format == LevelFormatJson || format == LevelFormatBoth {
+		levelJson, parents := level.ToJson()
+		if err := utils.WriteAsJsonFile(levelJson, path.Join(dirName, fmt.Sprintf("level%d.json", levelIndex))); err != nil {
+			return err
+		}
+		if err := utils.WriteAsJsonFile(parents, path.Join(dirName, fmt.Sprintf("parents%d.json", levelIndex))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var levelFilePattern = regexp.MustCompile(`^level(\d+)\.(json|bin)$`)
+
+// CountLevels returns how many levels are stored in dirPath, in either format
+func CountLevels(dirPath string) (int, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	number := 0
+	for _, entry := range entries {
+		if match := levelFilePattern.FindStringSubmatch(entry.Name()); match != nil {
+			i, _ := strconv.Atoi(match[1])
+			if i+1 > number {
+				number = i + 1
+			}
+		}
+	}
+	return number, nil
+}
+
+// ReadLevelFromDir reads level levelIndex, preferring the binary file when
+// both formats exist. parents{N}.json isn't needed since every region lists
+// its tiles.
+func ReadLevelFromDir(dirPath string, levelIndex int) (project_types.Level, error) {
+	binPath := path.Join(dirPath, fmt.Sprintf("level%d.bin", levelIndex))
+	if utils.FileExists(binPath) {
+		return ReadLevel(binPath)
+	}
+	return ReadLevel(path.Join(dirPath, fmt.Sprintf("level%d.json", levelIndex)))
 }
 
-func ReadLevels(dirPath string) ([]map[string]project_types.Region, []map[string]string) {
-	matches, err := filepath.Glob(path.Join(dirPath, "level*.json"))
+func ReadLevels(dirPath string) ([]project_types.Level, error) {
+	number, err := CountLevels(dirPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	number := len(matches)
 	log.Printf("%d levels found\n", number)
-	levels := make([]map[string]project_types.Region, number)
-	parents := make([]map[string]string, number+1)
+	levels := make([]project_types.Level, number)
+	errs := make([]error, number)
 	wg := sync.WaitGroup{}
 	for i := 0; i < number; i++ {
-		wg.Add(2)
+		wg.Add(1)
 		go func(i int) {
-			err := utils.ReadJsonFile(path.Join(dirPath, fmt.Sprintf("level%d.json", i)), &levels[i])
-			if err != nil {
-				panic(err)
-			}
-			wg.Done()
-		}(i)
-		go func(i int) {
-			err := utils.ReadJsonFile(path.Join(dirPath, fmt.Sprintf("parents%d.json", i)), &parents[i])
-			if err != nil {
-				panic(err)
-			}
+			levels[i], errs[i] = ReadLevelFromDir(dirPath, i)
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
-	return levels, parents
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return levels, nil
 }
 
-func WriteCountryMaps(countryPolygons project_types.CountryPolygons, countryToH3 project_types.CountryToH3, h3ToCountry project_types.H3ToCountry, dirName string) error {
+// WriteCountryMaps writes the country maps. h3ToCountry.json maps tiles to
+// country codes and countryToH3.json holds every code's display name and tiles.
+func WriteCountryMaps(countryPolygons project_types.CountryPolygons, countryToH3 project_types.CountryToH3, h3ToCountry project_types.H3ToCountry, countryNames project_types.CountryNames, dirName string) error {
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	errs := [3]error{}
@@ -223,7 +365,15 @@ func WriteCountryMaps(countryPolygons project_types.CountryPolygons, countryToH3
 		wg.Done()
 	}()
 	go func() {
-		errs[1] = utils.WriteAsJsonFile(countryToH3, path.Join(dirName, "countryToH3.json"))
+		countries := make(map[string]project_types.CountryEntry, len(countryToH3))
+		for country, tiles := range countryToH3 {
+			name, ok := countryNames[country]
+			if !ok {
+				name = country
+			}
+			countries[country] = project_types.CountryEntry{Name: name, Tiles: project_types.H3Strings(tiles)}
+		}
+		errs[1] = utils.WriteAsJsonFile(countries, path.Join(dirName, "countryToH3.json"))
 		wg.Done()
 	}()
 	go func() {
@@ -247,7 +397,9 @@ func ReadH3ToCountry(filePath string) (project_types.H3ToCountry, error) {
 	return h3ToCountry, nil
 }
 
-func ReadCountryMaps(dirName string) (project_types.CountryPolygons, project_types.CountryToH3, project_types.H3ToCountry, error) {
+// ReadCountryMaps reads the files written by WriteCountryMaps. countryToH3.json
+// files from before display names were stored map names straight to tiles.
+func ReadCountryMaps(dirName string) (project_types.CountryPolygons, project_types.CountryToH3, project_types.H3ToCountry, project_types.CountryNames, error) {
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	errs := [3]error{}
@@ -257,8 +409,9 @@ func ReadCountryMaps(dirName string) (project_types.CountryPolygons, project_typ
 		wg.Done()
 	}()
 	countryToH3 := project_types.CountryToH3{}
+	countryNames := project_types.CountryNames{}
 	go func() {
-		errs[1] = utils.ReadJsonFile(dirName+"/countryToH3.json", &countryToH3)
+		errs[1] = readCountryToH3(dirName+"/countryToH3.json", countryToH3, countryNames)
 		wg.Done()
 	}()
 	h3ToCountry := project_types.H3ToCountry{}
@@ -269,8 +422,106 @@ func ReadCountryMaps(dirName string) (project_types.CountryPolygons, project_typ
 	wg.Wait()
 	for _, err := range errs {
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
+		}
+	}
+	return countryPolygons, countryToH3, h3ToCountry, countryNames, nil
+}
+
+// ReadOceanTiles reads the ocean tiles of a data directory, none for
+// directories generated before ocean tiles were written
+func ReadOceanTiles(dirName string) (map[h3.H3Index]bool, error) {
+	filePath := path.Join(dirName, "oceanTiles.json")
+	ocean := map[h3.H3Index]bool{}
+	if !utils.FileExists(filePath) {
+		return ocean, nil
+	}
+	tiles := []string{}
+	if err := utils.ReadJsonFile(filePath, &tiles); err != nil {
+		return nil, err
+	}
+	for _, tile := range tiles {
+		ocean[h3.FromString(tile)] = true
+	}
+	return ocean, nil
+}
+
+func readCountryToH3(filePath string, countryToH3 project_types.CountryToH3, countryNames project_types.CountryNames) error {
+	countries := map[string]json.RawMessage{}
+	if err := utils.ReadJsonFile(filePath, &countries); err != nil {
+		return err
+	}
+	for country, raw := range countries {
+		entry := project_types.CountryEntry{Name: country}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			if err := json.Unmarshal(raw, &entry.Tiles); err != nil {
+				return fmt.Errorf("%s: %w", country, err)
+			}
+		} else if err := json.Unmarshal(raw, &entry); err != nil {
+			return fmt.Errorf("%s: %w", country, err)
+		}
+		countryToH3[country] = project_types.H3Indexes(entry.Tiles)
+		countryNames[country] = entry.Name
+	}
+	return nil
+}
+
+func LevelToGeoJson(level project_types.Level) project_types.RegionFeatureCollection {
+	collection := project_types.RegionFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]project_types.RegionFeature, len(level)),
+	}
+	for i, region := range level {
+		neighbors := make([]string, len(region.Neighbors))
+		for j, neighbor := range region.Neighbors {
+			neighbors[j] = h3.ToString(level[neighbor].Index)
+		}
+
+		feature := project_types.RegionFeature{
+			Type: "Feature",
+			Properties: project_types.RegionFeatureProperties{
+				Index:      h3.ToString(region.Index),
+				Population: region.Population,
+				Weights:    region.Weights,
+				Centroid:   region.Centroid,
+				Neighbors:  neighbors,
+			},
+		}
+		feature.Geometry.Type = "MultiPolygon"
+		feature.Geometry.Coordinates = [][][][2]float64{}
+		for _, polygon := range utils.H3SetToPolygons(region.Tiles) {
+			rings := [][][2]float64{}
+			for _, ring := range polygon {
+				// geojson does lng,lat instead of lat,lng
+				coords := make([][2]float64, len(ring))
+				for j, coord := range ring {
+					coords[j] = [2]float64{coord.Longitude, coord.Latitude}
+				}
+				rings = append(rings, coords)
+			}
+			feature.Geometry.Coordinates = append(feature.Geometry.Coordinates, rings)
+		}
+		collection.Features[i] = feature
+	}
+	return collection
+}
+
+// writes level{N}.geojson into outDir for every level in dataDir
+func ExportLevelsGeoJson(dataDir string, outDir string) error {
+	number, err := CountLevels(dataDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d levels found\n", number)
+	for i := 0; i < number; i++ {
+		log.Printf("exporting level %d\n", i)
+		level, err := ReadLevelFromDir(dataDir, i)
+		if err != nil {
+			return err
+		}
+		if err := utils.WriteAsJsonFile(LevelToGeoJson(level), path.Join(outDir, fmt.Sprintf("level%d.geojson", i))); err != nil {
+			return err
 		}
 	}
-	return countryPolygons, countryToH3, h3ToCountry, nil
+	return nil
 }
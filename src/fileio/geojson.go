@@ -0,0 +1,76 @@
+package fileio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	"github.com/mappichat/regions-engine/src/utils"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// geometryPolygons converts a geojson geometry into h3 polygons. Polygons
+// crossing the antimeridian are split into one polygon on each side of it.
+func geometryPolygons(geometry *project_types.GeoJsonGeometry) ([]h3.GeoPolygon, error) {
+	switch strings.ToLower(geometry.Type) {
+	case "polygon":
+		rings := [][][]float64{}
+		if err := json.Unmarshal(geometry.Coordinates, &rings); err != nil {
+			return nil, fmt.Errorf("polygon coordinates: %w", err)
+		}
+		return ringsToPolygons(rings)
+	case "multipolygon":
+		polygons := [][][][]float64{}
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("multipolygon coordinates: %w", err)
+		}
+		out := []h3.GeoPolygon{}
+		for i, rings := range polygons {
+			converted, err := ringsToPolygons(rings)
+			if err != nil {
+				return nil, fmt.Errorf("polygon %d: %w", i, err)
+			}
+			out = append(out, converted...)
+		}
+		return out, nil
+	case "geometrycollection":
+		out := []h3.GeoPolygon{}
+		for i := range geometry.Geometries {
+			converted, err := geometryPolygons(&geometry.Geometries[i])
+			if err != nil {
+				return nil, fmt.Errorf("geometry %d: %w", i, err)
+			}
+			out = append(out, converted...)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported geometry type %q, only Polygon, MultiPolygon and GeometryCollection cover an area", geometry.Type)
+}
+
+// ringsToPolygons converts geojson rings, [lng, lat(, altitude)] positions
+// with the outer ring first, into h3 polygons
+func ringsToPolygons(rings [][][]float64) ([]h3.GeoPolygon, error) {
+	if len(rings) == 0 {
+		return nil, errors.New("polygon has no rings")
+	}
+	converted := make([][]h3.GeoCoord, len(rings))
+	for i, ring := range rings {
+		if len(ring) < 3 {
+			return nil, fmt.Errorf("ring %d has %d positions, a ring needs at least 3", i, len(ring))
+		}
+		converted[i] = make([]h3.GeoCoord, len(ring))
+		for j, position := range ring {
+			if len(position) < 2 {
+				return nil, fmt.Errorf("ring %d position %d has %d coordinates, it needs a longitude and a latitude", i, j, len(position))
+			}
+			// geojson does lng,lat instead of lat,lng
+			if position[1] < -90 || position[1] > 90 {
+				return nil, fmt.Errorf("ring %d position %d has latitude %g, are longitude and latitude swapped?", i, j, position[1])
+			}
+			converted[i][j] = h3.GeoCoord{Latitude: position[1], Longitude: position[0]}
+		}
+	}
+	return utils.SplitAntimeridian(converted), nil
+}
@@ -0,0 +1,610 @@
+package fileio
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tiff tags read by geoTiff
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagPlanarConfig    = 284
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+	tagSampleFormat    = 339
+	tagPixelScale      = 33550
+	tagTiepoint        = 33922
+	tagTransformation  = 34264
+	tagGeoKeyDirectory = 34735
+	tagGdalNoData      = 42113
+)
+
+// geo keys read by geoTiff
+const (
+	geoKeyModelType  = 1024
+	geoKeyRasterType = 1025
+	modelProjected   = 1
+	rasterPixelPoint = 2
+)
+
+// byte sizes of tiff field types, indexed by type
+var tiffTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 8, 0, 0, 8, 8, 8}
+
+type tiffField struct {
+	typ   int
+	count int
+	raw   []byte
+}
+
+// geoTiff is the first image of a geographic (lat/lng) GeoTIFF. Only the
+// first band is read. Pixel data stays on disk and is decoded one strip or
+// tile at a time.
+type geoTiff struct {
+	file          *os.File
+	order         binary.ByteOrder
+	width         int
+	height        int
+	bitsPerSample int
+	samples       int // per pixel, interleaved unless planar
+	planar        bool
+	sampleFormat  int // 1 unsigned, 2 signed, 3 float
+	compression   int
+	predictor     int
+	chunkWidth    int // strips span the whole width
+	chunkHeight   int
+	offsets       []uint64
+	byteCounts    []uint64
+	originLng     float64 // of the outer corner of pixel 0, 0
+	originLat     float64
+	scaleLng      float64 // pixel size in degrees
+	scaleLat      float64
+	noData        float64
+	hasNoData     bool
+}
+
+func openGeoTiff(filePath string) (*geoTiff, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	t := &geoTiff{file: file}
+	if err := t.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return t, nil
+}
+
+func (t *geoTiff) Close() error {
+	return t.file.Close()
+}
+
+func (t *geoTiff) readAt(offset uint64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := t.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("reading %d bytes at %d: %w", size, offset, err)
+	}
+	return buf, nil
+}
+
+func (t *geoTiff) readHeader() error {
+	header, err := t.readAt(0, 16)
+	if err != nil {
+		return errors.New("not a tiff file")
+	}
+	switch string(header[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errors.New("not a tiff file")
+	}
+
+	big := false
+	var ifdOffset uint64
+	switch t.order.Uint16(header[2:]) {
+	case 42:
+		ifdOffset = uint64(t.order.Uint32(header[4:]))
+	case 43:
+		big = true
+		ifdOffset = t.order.Uint64(header[8:])
+	default:
+		return errors.New("not a tiff file")
+	}
+
+	fields, err := t.readIFD(ifdOffset, big)
+	if err != nil {
+		return err
+	}
+	return t.parseFields(fields)
+}
+
+// readIFD reads the fields of the image file directory at offset, in the
+// classic or the BigTIFF layout
+func (t *geoTiff) readIFD(offset uint64, big bool) (map[int]tiffField, error) {
+	countSize, entrySize, inlineSize := 2, 12, 4
+	if big {
+		countSize, entrySize, inlineSize = 8, 20, 8
+	}
+	countBytes, err := t.readAt(offset, countSize)
+	if err != nil {
+		return nil, err
+	}
+	var entries uint64
+	if big {
+		entries = t.order.Uint64(countBytes)
+	} else {
+		entries = uint64(t.order.Uint16(countBytes))
+	}
+	table, err := t.readAt(offset+uint64(countSize), int(entries)*entrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[int]tiffField{}
+	for i := 0; i < int(entries); i++ {
+		entry := table[i*entrySize : (i+1)*entrySize]
+		tag := int(t.order.Uint16(entry))
+		typ := int(t.order.Uint16(entry[2:]))
+		var count uint64
+		var value []byte
+		if big {
+			count = t.order.Uint64(entry[4:])
+			value = entry[12:20]
+		} else {
+			count = uint64(t.order.Uint32(entry[4:]))
+			value = entry[8:12]
+		}
+		if typ >= len(tiffTypeSizes) || tiffTypeSizes[typ] == 0 {
+			continue // types geoTiff never needs
+		}
+		size := int(count) * tiffTypeSizes[typ]
+		raw := value[:0]
+		if size <= inlineSize {
+			raw = value[:size]
+		} else {
+			var at uint64
+			if big {
+				at = t.order.Uint64(value)
+			} else {
+				at = uint64(t.order.Uint32(value))
+			}
+			if raw, err = t.readAt(at, size); err != nil {
+				return nil, fmt.Errorf("tag %d: %w", tag, err)
+			}
+		}
+		fields[tag] = tiffField{typ: typ, count: int(count), raw: raw}
+	}
+	return fields, nil
+}
+
+func (t *geoTiff) numbers(field tiffField) []float64 {
+	values := make([]float64, field.count)
+	size := tiffTypeSizes[field.typ]
+	for i := range values {
+		b := field.raw[i*size:]
+		switch field.typ {
+		case 1, 7:
+			values[i] = float64(b[0])
+		case 6:
+			values[i] = float64(int8(b[0]))
+		case 3:
+			values[i] = float64(t.order.Uint16(b))
+		case 8:
+			values[i] = float64(int16(t.order.Uint16(b)))
+		case 4:
+			values[i] = float64(t.order.Uint32(b))
+		case 9:
+			values[i] = float64(int32(t.order.Uint32(b)))
+		case 5:
+			values[i] = float64(t.order.Uint32(b)) / float64(t.order.Uint32(b[4:]))
+		case 10:
+			values[i] = float64(int32(t.order.Uint32(b))) / float64(int32(t.order.Uint32(b[4:])))
+		case 11:
+			values[i] = float64(math.Float32frombits(t.order.Uint32(b)))
+		case 12:
+			values[i] = math.Float64frombits(t.order.Uint64(b))
+		case 16, 18:
+			values[i] = float64(t.order.Uint64(b))
+		case 17:
+			values[i] = float64(int64(t.order.Uint64(b)))
+		}
+	}
+	return values
+}
+
+// offsets are read as integers since large files have offsets past float64 precision
+func (t *geoTiff) offsetList(field tiffField) []uint64 {
+	values := make([]uint64, field.count)
+	for i := range values {
+		switch field.typ {
+		case 3:
+			values[i] = uint64(t.order.Uint16(field.raw[i*2:]))
+		case 4:
+			values[i] = uint64(t.order.Uint32(field.raw[i*4:]))
+		case 16:
+			values[i] = t.order.Uint64(field.raw[i*8:])
+		}
+	}
+	return values
+}
+
+func (t *geoTiff) parseFields(fields map[int]tiffField) error {
+	number := func(tag int, fallback float64) float64 {
+		if field, ok := fields[tag]; ok && field.count > 0 {
+			return t.numbers(field)[0]
+		}
+		return fallback
+	}
+
+	t.width = int(number(tagImageWidth, 0))
+	t.height = int(number(tagImageLength, 0))
+	if t.width == 0 || t.height == 0 {
+		return errors.New("image has no width or height")
+	}
+	t.bitsPerSample = int(number(tagBitsPerSample, 1))
+	t.samples = int(number(tagSamplesPerPixel, 1))
+	t.planar = number(tagPlanarConfig, 1) == 2
+	t.sampleFormat = int(number(tagSampleFormat, 1))
+	t.compression = int(number(tagCompression, 1))
+	t.predictor = int(number(tagPredictor, 1))
+
+	switch t.sampleFormat {
+	case 1, 2:
+		if t.bitsPerSample != 8 && t.bitsPerSample != 16 && t.bitsPerSample != 32 && t.bitsPerSample != 64 {
+			return fmt.Errorf("%d bit integer samples are not supported", t.bitsPerSample)
+		}
+	case 3:
+		if t.bitsPerSample != 32 && t.bitsPerSample != 64 {
+			return fmt.Errorf("%d bit float samples are not supported", t.bitsPerSample)
+		}
+	default:
+		return fmt.Errorf("sample format %d is not supported", t.sampleFormat)
+	}
+	switch t.compression {
+	case 1, 5, 8, 32946, 32773:
+	default:
+		return fmt.Errorf("compression %d is not supported, convert the file with gdal_translate -co COMPRESS=DEFLATE", t.compression)
+	}
+	if t.predictor != 1 && t.predictor != 2 && t.predictor != 3 {
+		return fmt.Errorf("predictor %d is not supported", t.predictor)
+	}
+
+	if offsets, ok := fields[tagTileOffsets]; ok {
+		t.chunkWidth = int(number(tagTileWidth, 0))
+		t.chunkHeight = int(number(tagTileLength, 0))
+		t.offsets = t.offsetList(offsets)
+		t.byteCounts = t.offsetList(fields[tagTileByteCounts])
+	} else if offsets, ok := fields[tagStripOffsets]; ok {
+		t.chunkWidth = t.width
+		t.chunkHeight = int(number(tagRowsPerStrip, float64(t.height)))
+		if t.chunkHeight > t.height {
+			t.chunkHeight = t.height
+		}
+		t.offsets = t.offsetList(offsets)
+		t.byteCounts = t.offsetList(fields[tagStripByteCounts])
+	} else {
+		return errors.New("image has neither strips nor tiles")
+	}
+	if t.chunkWidth == 0 || t.chunkHeight == 0 || len(t.byteCounts) != len(t.offsets) || len(t.offsets) < t.chunksPerPlane() {
+		return errors.New("image strip or tile layout is incomplete")
+	}
+
+	if field, ok := fields[tagGdalNoData]; ok {
+		text := strings.Trim(strings.TrimSpace(string(field.raw)), "\x00")
+		if value, err := strconv.ParseFloat(text, 64); err == nil {
+			t.noData = value
+			t.hasNoData = true
+		}
+	}
+	return t.parseGeoreference(fields)
+}
+
+func (t *geoTiff) parseGeoreference(fields map[int]tiffField) error {
+	pointPixels := false
+	if field, ok := fields[tagGeoKeyDirectory]; ok {
+		keys := t.numbers(field)
+		for i := 4; i+3 < len(keys); i += 4 {
+			// only keys stored inline in the directory matter here
+			if keys[i+1] != 0 {
+				continue
+			}
+			switch int(keys[i]) {
+			case geoKeyModelType:
+				if keys[i+3] == modelProjected {
+					return errors.New("the raster uses a projected coordinate system, only geographic (lat/lng) rasters are supported; reproject it with gdalwarp -t_srs EPSG:4326")
+				}
+			case geoKeyRasterType:
+				pointPixels = keys[i+3] == rasterPixelPoint
+			}
+		}
+	}
+
+	if scale, ok := fields[tagPixelScale]; ok {
+		tiepoint, ok := fields[tagTiepoint]
+		if !ok || tiepoint.count < 6 || scale.count < 2 {
+			return errors.New("the raster has a pixel scale but no tie point")
+		}
+		s := t.numbers(scale)
+		p := t.numbers(tiepoint)
+		t.scaleLng, t.scaleLat = s[0], s[1]
+		t.originLng = p[3] - p[0]*s[0]
+		t.originLat = p[4] + p[1]*s[1]
+	} else if transformation, ok := fields[tagTransformation]; ok && transformation.count == 16 {
+		m := t.numbers(transformation)
+		if m[1] != 0 || m[4] != 0 {
+			return errors.New("rotated rasters are not supported")
+		}
+		t.scaleLng, t.scaleLat = m[0], -m[5]
+		t.originLng, t.originLat = m[3], m[7]
+	} else {
+		return errors.New("the raster isn't georeferenced, it has no pixel scale or transformation")
+	}
+	if t.scaleLng <= 0 || t.scaleLat <= 0 {
+		return fmt.Errorf("unsupported pixel size %g x %g", t.scaleLng, t.scaleLat)
+	}
+	if pointPixels { // coordinates are of pixel centers instead of corners
+		t.originLng -= t.scaleLng / 2
+		t.originLat += t.scaleLat / 2
+	}
+	return nil
+}
+
+func (t *geoTiff) chunksAcross() int {
+	return (t.width + t.chunkWidth - 1) / t.chunkWidth
+}
+
+func (t *geoTiff) chunksPerPlane() int {
+	return t.chunksAcross() * ((t.height + t.chunkHeight - 1) / t.chunkHeight)
+}
+
+// eachChunk decodes the first band strip by strip or tile by tile. fn gets
+// the chunk's position and its values, row by row with chunkWidth values a row.
+func (t *geoTiff) eachChunk(fn func(x0 int, y0 int, values []float64) error) error {
+	samples := t.samples
+	if t.planar {
+		samples = 1
+	}
+	bytesPerSample := t.bitsPerSample / 8
+	rowBytes := t.chunkWidth * samples * bytesPerSample
+	values := make([]float64, t.chunkWidth*t.chunkHeight)
+
+	for i := 0; i < t.chunksPerPlane(); i++ {
+		x0 := (i % t.chunksAcross()) * t.chunkWidth
+		y0 := (i / t.chunksAcross()) * t.chunkHeight
+		rows := t.chunkHeight
+		if y0+rows > t.height {
+			rows = t.height - y0 // the last strip can be short, tiles are always padded
+		}
+
+		compressed, err := t.readAt(t.offsets[i], int(t.byteCounts[i]))
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		data, err := t.decompress(compressed, rowBytes*rows)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		if len(data) < rowBytes*rows {
+			// strips are allowed to end early when the rest is padding
+			data = append(data, make([]byte, rowBytes*rows-len(data))...)
+		}
+
+		order := t.order
+		for row := 0; row < rows; row++ {
+			rowData := data[row*rowBytes : (row+1)*rowBytes]
+			switch t.predictor {
+			case 2:
+				undoHorizontalPredictor(rowData, samples, bytesPerSample, t.order)
+			case 3:
+				undoFloatPredictor(rowData, samples, bytesPerSample)
+				order = binary.BigEndian
+			}
+			for col := 0; col < t.chunkWidth; col++ {
+				values[row*t.chunkWidth+col] = t.sample(rowData[col*samples*bytesPerSample:], order)
+			}
+		}
+		if err := fn(x0, y0, values[:rows*t.chunkWidth]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *geoTiff) sample(b []byte, order binary.ByteOrder) float64 {
+	switch t.sampleFormat {
+	case 3:
+		if t.bitsPerSample == 32 {
+			return float64(math.Float32frombits(order.Uint32(b)))
+		}
+		return math.Float64frombits(order.Uint64(b))
+	case 2:
+		switch t.bitsPerSample {
+		case 8:
+			return float64(int8(b[0]))
+		case 16:
+			return float64(int16(order.Uint16(b)))
+		case 32:
+			return float64(int32(order.Uint32(b)))
+		}
+		return float64(int64(order.Uint64(b)))
+	}
+	switch t.bitsPerSample {
+	case 8:
+		return float64(b[0])
+	case 16:
+		return float64(order.Uint16(b))
+	case 32:
+		return float64(order.Uint32(b))
+	}
+	return float64(order.Uint64(b))
+}
+
+func (t *geoTiff) decompress(data []byte, size int) ([]byte, error) {
+	switch t.compression {
+	case 5:
+		return lzwDecode(data, size)
+	case 8, 32946:
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		out := make([]byte, 0, size)
+		buf := bytes.NewBuffer(out)
+		if _, err := io.Copy(buf, reader); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case 32773:
+		return packBitsDecode(data, size), nil
+	}
+	return data, nil
+}
+
+// undoHorizontalPredictor turns the differences to the previous pixel back
+// into values
+func undoHorizontalPredictor(row []byte, samples int, bytesPerSample int, order binary.ByteOrder) {
+	stride := samples * bytesPerSample
+	for i := stride; i+bytesPerSample <= len(row); i += bytesPerSample {
+		b, prev := row[i:], row[i-stride:]
+		switch bytesPerSample {
+		case 1:
+			b[0] += prev[0]
+		case 2:
+			order.PutUint16(b, order.Uint16(b)+order.Uint16(prev))
+		case 4:
+			order.PutUint32(b, order.Uint32(b)+order.Uint32(prev))
+		case 8:
+			order.PutUint64(b, order.Uint64(b)+order.Uint64(prev))
+		}
+	}
+}
+
+// undoFloatPredictor reverses the floating point predictor, which stores the
+// byte differences of a row with the most significant bytes of every value
+// first. The values come out big endian.
+func undoFloatPredictor(row []byte, samples int, bytesPerSample int) {
+	for i := samples; i < len(row); i++ {
+		row[i] += row[i-samples]
+	}
+	values := len(row) / bytesPerSample
+	shuffled := append([]byte{}, row...)
+	for i := 0; i < values; i++ {
+		for b := 0; b < bytesPerSample; b++ {
+			row[i*bytesPerSample+b] = shuffled[b*values+i]
+		}
+	}
+}
+
+// lzwDecode decodes tiff's flavor of LZW: codes are written most significant
+// bit first and get wider one code earlier than in other formats
+func lzwDecode(src []byte, size int) ([]byte, error) {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+		maxWidth  = 12
+	)
+	var prefix [1 << maxWidth]int
+	var suffix [1 << maxWidth]byte
+	var length [1 << maxWidth]int
+	for i := 0; i < 256; i++ {
+		suffix[i] = byte(i)
+		length[i] = 1
+	}
+
+	out := make([]byte, 0, size)
+	// appendEntry writes the bytes of code, which are stored back to front
+	appendEntry := func(code int) byte {
+		n := length[code]
+		out = append(out, make([]byte, n)...)
+		for i := len(out) - 1; i >= len(out)-n; i-- {
+			out[i] = suffix[code]
+			code = prefix[code]
+		}
+		return out[len(out)-n]
+	}
+
+	width, next, prev := 9, 258, -1
+	bitPos := 0
+	for bitPos+width <= len(src)*8 {
+		code := 0
+		for i := 0; i < width; i++ {
+			bit := (src[(bitPos+i)/8] >> (7 - uint((bitPos+i)%8))) & 1
+			code = code<<1 | int(bit)
+		}
+		bitPos += width
+
+		if code == eoiCode {
+			break
+		}
+		if code == clearCode {
+			width, next, prev = 9, 258, -1
+			continue
+		}
+
+		var first byte
+		switch {
+		case code < next && (code < 256 || code >= 258):
+			first = appendEntry(code)
+		case code == next && prev >= 0:
+			first = appendEntry(prev)
+			out = append(out, first)
+		default:
+			return nil, fmt.Errorf("invalid lzw code %d", code)
+		}
+		if prev >= 0 && next < 1<<maxWidth {
+			prefix[next] = prev
+			suffix[next] = first
+			length[next] = length[prev] + 1
+			next++
+			if next >= 1<<width-1 && width < maxWidth {
+				width++
+			}
+		}
+		prev = code
+	}
+	return out, nil
+}
+
+func packBitsDecode(src []byte, size int) []byte {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			end := i + n + 1
+			if end > len(src) {
+				end = len(src)
+			}
+			out = append(out, src[i:end]...)
+			i = end
+		case n != -128:
+			if i < len(src) {
+				out = append(out, bytes.Repeat(src[i:i+1], 1-n)...)
+			}
+			i++
+		}
+	}
+	return out
+}
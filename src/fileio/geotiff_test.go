@@ -0,0 +1,595 @@
+package fileio
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// the test images are not a multiple of the tile size, so edge tiles are padded
+const (
+	testTiffWidth  = 37
+	testTiffHeight = 23
+)
+
+type testTiffField struct {
+	tag   int
+	typ   int
+	count int
+	data  []byte
+}
+
+// testTiff describes a GeoTIFF for writeTestTiff to encode
+type testTiff struct {
+	order        binary.ByteOrder
+	big          bool
+	bits         int
+	format       int // 1 unsigned, 2 signed, 3 float
+	compression  int
+	predictor    int
+	samples      int
+	planar       bool
+	rowsPerStrip int // strips unless tileSize is set
+	tileSize     int
+	geo          func(order binary.ByteOrder) []testTiffField // the default georeference when nil
+	noData       string
+}
+
+// testTiffValue is the value of band at x, y, every band differs so reading
+// the wrong one shows
+func testTiffValue(x int, y int, band int, format int) float64 {
+	v := float64((x*7 + y*13 + band*50) % 251)
+	switch format {
+	case 2:
+		v -= 100
+	case 3:
+		v = v/4 - 20
+	}
+	return v
+}
+
+func testShorts(order binary.ByteOrder, values ...int) []byte {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		order.PutUint16(b[i*2:], uint16(v))
+	}
+	return b
+}
+
+func testDoubles(order binary.ByteOrder, values ...float64) []byte {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		order.PutUint64(b[i*8:], math.Float64bits(v))
+	}
+	return b
+}
+
+func testUint(b []byte, size int, order binary.ByteOrder) uint64 {
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	}
+	return order.Uint64(b)
+}
+
+func putTestUint(b []byte, size int, order binary.ByteOrder, v uint64) {
+	switch size {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, uint32(v))
+	default:
+		order.PutUint64(b, v)
+	}
+}
+
+func (tt testTiff) putSample(b []byte, v float64) {
+	size := tt.bits / 8
+	if tt.format == 3 {
+		if size == 4 {
+			tt.order.PutUint32(b, math.Float32bits(float32(v)))
+		} else {
+			tt.order.PutUint64(b, math.Float64bits(v))
+		}
+		return
+	}
+	putTestUint(b, size, tt.order, uint64(int64(v)))
+}
+
+// predict applies the predictor to a row of samplesPerPixel interleaved samples
+func (tt testTiff) predict(row []byte, samplesPerPixel int) {
+	size := tt.bits / 8
+	switch tt.predictor {
+	case 2:
+		for i := len(row)/size - 1; i >= samplesPerPixel; i-- {
+			b, prev := row[i*size:], row[(i-samplesPerPixel)*size:]
+			putTestUint(b, size, tt.order, testUint(b, size, tt.order)-testUint(prev, size, tt.order))
+		}
+	case 3:
+		values := len(row) / size
+		shuffled := make([]byte, len(row))
+		value := make([]byte, size)
+		for i := 0; i < values; i++ {
+			putTestUint(value, size, binary.BigEndian, testUint(row[i*size:], size, tt.order))
+			for b := 0; b < size; b++ {
+				shuffled[b*values+i] = value[b]
+			}
+		}
+		for i := len(shuffled) - 1; i >= samplesPerPixel; i-- {
+			shuffled[i] -= shuffled[i-samplesPerPixel]
+		}
+		copy(row, shuffled)
+	}
+}
+
+func (tt testTiff) compress(data []byte) []byte {
+	switch tt.compression {
+	case 5:
+		return testLzwEncode(data)
+	case 8, 32946:
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	case 32773:
+		return testPackBitsEncode(data)
+	}
+	return data
+}
+
+// chunks encodes the strips or tiles of every plane
+func (tt testTiff) chunks() [][]byte {
+	chunkWidth, chunkHeight := testTiffWidth, tt.rowsPerStrip
+	if tt.tileSize > 0 {
+		chunkWidth, chunkHeight = tt.tileSize, tt.tileSize
+	}
+	samplesPerPixel, planes := tt.samples, 1
+	if tt.planar {
+		samplesPerPixel, planes = 1, tt.samples
+	}
+	size := tt.bits / 8
+	rowBytes := chunkWidth * samplesPerPixel * size
+
+	chunks := [][]byte{}
+	for plane := 0; plane < planes; plane++ {
+		for y0 := 0; y0 < testTiffHeight; y0 += chunkHeight {
+			for x0 := 0; x0 < testTiffWidth; x0 += chunkWidth {
+				rows := chunkHeight
+				if tt.tileSize == 0 && y0+rows > testTiffHeight {
+					rows = testTiffHeight - y0
+				}
+				data := make([]byte, rows*rowBytes)
+				for r := 0; r < rows; r++ {
+					row := data[r*rowBytes : (r+1)*rowBytes]
+					for c := 0; c < chunkWidth; c++ {
+						x, y := x0+c, y0+r
+						if x >= testTiffWidth || y >= testTiffHeight {
+							continue // padding
+						}
+						for s := 0; s < samplesPerPixel; s++ {
+							tt.putSample(row[(c*samplesPerPixel+s)*size:], testTiffValue(x, y, plane+s, tt.format))
+						}
+					}
+					tt.predict(row, samplesPerPixel)
+				}
+				chunks = append(chunks, tt.compress(data))
+			}
+		}
+	}
+	return chunks
+}
+
+// defaultTestGeo puts the corner of pixel 2, 4 at -9, 19 with 0.5 x 0.25
+// degree pixels, so the image's corner is at -10, 20
+func defaultTestGeo(order binary.ByteOrder) []testTiffField {
+	return []testTiffField{
+		{tagPixelScale, 12, 3, testDoubles(order, 0.5, 0.25, 0)},
+		{tagTiepoint, 12, 6, testDoubles(order, 2, 4, 0, -9, 19, 0)},
+		{tagGeoKeyDirectory, 3, 8, testShorts(order, 1, 1, 0, 1, geoKeyModelType, 0, 1, 2)},
+	}
+}
+
+// writeTestTiff encodes tt into a file in a temporary directory
+func writeTestTiff(t *testing.T, tt testTiff) string {
+	t.Helper()
+	order := tt.order
+	offsetType, offsetSize := 4, 4
+	headerSize, countSize, entrySize, inlineSize := 8, 2, 12, 4
+	if tt.big {
+		offsetType, offsetSize = 16, 8
+		headerSize, countSize, entrySize, inlineSize = 16, 8, 20, 8
+	}
+
+	body := []byte{}
+	offsets, byteCounts := []byte{}, []byte{}
+	for _, chunk := range tt.chunks() {
+		offset, count := make([]byte, offsetSize), make([]byte, offsetSize)
+		putTestUint(offset, offsetSize, order, uint64(headerSize+len(body)))
+		putTestUint(count, offsetSize, order, uint64(len(chunk)))
+		offsets = append(offsets, offset...)
+		byteCounts = append(byteCounts, count...)
+		body = append(body, chunk...)
+	}
+	chunkCount := len(offsets) / offsetSize
+
+	perSample := func(value int) []byte {
+		values := make([]int, tt.samples)
+		for i := range values {
+			values[i] = value
+		}
+		return testShorts(order, values...)
+	}
+	planar := 1
+	if tt.planar {
+		planar = 2
+	}
+	fields := []testTiffField{
+		{tagImageWidth, 3, 1, testShorts(order, testTiffWidth)},
+		{tagImageLength, 3, 1, testShorts(order, testTiffHeight)},
+		{tagBitsPerSample, 3, tt.samples, perSample(tt.bits)},
+		{tagCompression, 3, 1, testShorts(order, tt.compression)},
+		{262, 3, 1, testShorts(order, 1)}, // photometric interpretation
+		{tagSamplesPerPixel, 3, 1, testShorts(order, tt.samples)},
+		{tagPlanarConfig, 3, 1, testShorts(order, planar)},
+		{tagPredictor, 3, 1, testShorts(order, tt.predictor)},
+		{tagSampleFormat, 3, tt.samples, perSample(tt.format)},
+	}
+	if tt.tileSize > 0 {
+		fields = append(fields,
+			testTiffField{tagTileWidth, 3, 1, testShorts(order, tt.tileSize)},
+			testTiffField{tagTileLength, 3, 1, testShorts(order, tt.tileSize)},
+			testTiffField{tagTileOffsets, offsetType, chunkCount, offsets},
+			testTiffField{tagTileByteCounts, offsetType, chunkCount, byteCounts},
+		)
+	} else {
+		fields = append(fields,
+			testTiffField{tagStripOffsets, offsetType, chunkCount, offsets},
+			testTiffField{tagRowsPerStrip, 3, 1, testShorts(order, tt.rowsPerStrip)},
+			testTiffField{tagStripByteCounts, offsetType, chunkCount, byteCounts},
+		)
+	}
+	geo := tt.geo
+	if geo == nil {
+		geo = defaultTestGeo
+	}
+	fields = append(fields, geo(order)...)
+	if tt.noData != "" {
+		fields = append(fields, testTiffField{tagGdalNoData, 2, len(tt.noData) + 1, append([]byte(tt.noData), 0)})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	ifdOffset := headerSize + len(body)
+	extraOffset := ifdOffset + countSize + len(fields)*entrySize + inlineSize
+	ifd := make([]byte, countSize)
+	putTestUint(ifd, countSize, order, uint64(len(fields)))
+	extra := []byte{}
+	for _, field := range fields {
+		entry := make([]byte, entrySize)
+		order.PutUint16(entry, uint16(field.tag))
+		order.PutUint16(entry[2:], uint16(field.typ))
+		value := entry[8:]
+		if tt.big {
+			order.PutUint64(entry[4:], uint64(field.count))
+			value = entry[12:]
+		} else {
+			order.PutUint32(entry[4:], uint32(field.count))
+		}
+		if len(field.data) <= inlineSize {
+			copy(value, field.data)
+		} else {
+			putTestUint(value, inlineSize, order, uint64(extraOffset+len(extra)))
+			extra = append(extra, field.data...)
+		}
+		ifd = append(ifd, entry...)
+	}
+	ifd = append(ifd, make([]byte, inlineSize)...) // no next directory
+
+	header := make([]byte, headerSize)
+	if order == binary.LittleEndian {
+		copy(header, "II")
+	} else {
+		copy(header, "MM")
+	}
+	if tt.big {
+		order.PutUint16(header[2:], 43)
+		order.PutUint16(header[4:], 8)
+		order.PutUint64(header[8:], uint64(ifdOffset))
+	} else {
+		order.PutUint16(header[2:], 42)
+		order.PutUint32(header[4:], uint32(ifdOffset))
+	}
+
+	file := append(append(append(header, body...), ifd...), extra...)
+	filePath := filepath.Join(t.TempDir(), "test.tif")
+	if err := os.WriteFile(filePath, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// testLzwEncode encodes like libtiff: codes get wider as soon as the next
+// free code needs the extra bit, and the table is cleared when it is full
+func testLzwEncode(src []byte) []byte {
+	out := []byte{}
+	var bits uint64
+	pending := 0
+	width := 9
+	emit := func(code int) {
+		bits = bits<<uint(width) | uint64(code)
+		pending += width
+		for pending >= 8 {
+			out = append(out, byte(bits>>uint(pending-8)))
+			pending -= 8
+		}
+	}
+	var table map[string]int
+	next := 258
+	reset := func() {
+		table = map[string]int{}
+		for i := 0; i < 256; i++ {
+			table[string([]byte{byte(i)})] = i
+		}
+		next, width = 258, 9
+	}
+	reset()
+	emit(256)
+	word := ""
+	for _, c := range src {
+		extended := word + string([]byte{c})
+		if _, ok := table[extended]; ok || word == "" {
+			word = extended
+			continue
+		}
+		emit(table[word])
+		table[extended] = next
+		next++
+		if next == 4094 {
+			emit(256)
+			reset()
+		} else if next >= 1<<width {
+			width++
+		}
+		word = string([]byte{c})
+	}
+	if word != "" {
+		emit(table[word])
+	}
+	emit(257)
+	if pending > 0 {
+		out = append(out, byte(bits<<uint(8-pending)))
+	}
+	return out
+}
+
+func testPackBitsEncode(src []byte) []byte {
+	out := []byte{}
+	for i := 0; i < len(src); {
+		run := 1
+		for i+run < len(src) && src[i+run] == src[i] && run < 128 {
+			run++
+		}
+		if run >= 3 {
+			out = append(out, byte(int8(1-run)), src[i])
+			i += run
+			continue
+		}
+		literal := i
+		for literal < len(src) && literal-i < 128 && (literal+2 >= len(src) || src[literal] != src[literal+1] || src[literal] != src[literal+2]) {
+			literal++
+		}
+		if literal == i {
+			literal++
+		}
+		out = append(out, byte(literal-i-1))
+		out = append(out, src[i:literal]...)
+		i = literal
+	}
+	return out
+}
+
+// readTestTiff decodes the first band of the tiff at filePath into rows
+func readTestTiff(t *testing.T, filePath string) (*geoTiff, []float64) {
+	t.Helper()
+	raster, err := openGeoTiff(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raster.Close() })
+	values := make([]float64, raster.width*raster.height)
+	for i := range values {
+		values[i] = math.NaN()
+	}
+	err = raster.eachChunk(func(x0 int, y0 int, chunk []float64) error {
+		for i, value := range chunk {
+			x, y := x0+i%raster.chunkWidth, y0+i/raster.chunkWidth
+			if x < raster.width && y < raster.height {
+				values[y*raster.width+x] = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raster, values
+}
+
+func TestGeoTiffDecoding(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	cases := map[string]testTiff{
+		"uncompressed float32 strips":                      {order: le, bits: 32, format: 3, compression: 1, predictor: 1, samples: 1, rowsPerStrip: 5},
+		"uncompressed uint8 tiles big endian":              {order: be, bits: 8, format: 1, compression: 1, predictor: 1, samples: 1, tileSize: 16},
+		"lzw int16 horizontal predictor strips":            {order: le, bits: 16, format: 2, compression: 5, predictor: 2, samples: 1, rowsPerStrip: 3},
+		"lzw float64 float predictor planar strips":        {order: le, bits: 64, format: 3, compression: 5, predictor: 3, samples: 2, planar: true, rowsPerStrip: 4},
+		"lzw uint32 single strip":                          {order: be, bits: 32, format: 1, compression: 5, predictor: 1, samples: 1, rowsPerStrip: testTiffHeight},
+		"deflate float32 float predictor tiles big endian": {order: be, bits: 32, format: 3, compression: 8, predictor: 3, samples: 1, tileSize: 16},
+		"deflate int32 horizontal predictor planar tiles":  {order: le, big: true, bits: 32, format: 2, compression: 8, predictor: 2, samples: 2, planar: true, tileSize: 16},
+		"adobe deflate uint16 horizontal predictor pixels": {order: be, bits: 16, format: 1, compression: 32946, predictor: 2, samples: 3, tileSize: 16},
+		"packbits uint8 bigtiff strips":                    {order: le, big: true, bits: 8, format: 1, compression: 32773, predictor: 1, samples: 1, rowsPerStrip: 7},
+		"packbits float64 float predictor pixels":          {order: be, bits: 64, format: 3, compression: 32773, predictor: 3, samples: 2, rowsPerStrip: 6},
+	}
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			raster, values := readTestTiff(t, writeTestTiff(t, tt))
+			if raster.width != testTiffWidth || raster.height != testTiffHeight {
+				t.Fatalf("size is %d x %d, want %d x %d", raster.width, raster.height, testTiffWidth, testTiffHeight)
+			}
+			for y := 0; y < testTiffHeight; y++ {
+				for x := 0; x < testTiffWidth; x++ {
+					if got, want := values[y*testTiffWidth+x], testTiffValue(x, y, 0, tt.format); got != want {
+						t.Fatalf("pixel %d, %d is %g, want %g", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGeoTiffGeoreference(t *testing.T) {
+	type georeference struct {
+		originLng, originLat, scaleLng, scaleLat float64
+	}
+	cases := map[string]struct {
+		geo  func(order binary.ByteOrder) []testTiffField
+		want georeference
+		err  string
+	}{
+		"tie point": {
+			geo:  defaultTestGeo,
+			want: georeference{-10, 20, 0.5, 0.25},
+		},
+		"pixel is point": {
+			geo: func(order binary.ByteOrder) []testTiffField {
+				return []testTiffField{
+					{tagPixelScale, 12, 3, testDoubles(order, 0.5, 0.25, 0)},
+					{tagTiepoint, 12, 6, testDoubles(order, 0, 0, 0, -10, 20, 0)},
+					{tagGeoKeyDirectory, 3, 8, testShorts(order, 1, 1, 0, 1, geoKeyRasterType, 0, 1, rasterPixelPoint)},
+				}
+			},
+			want: georeference{-10.25, 20.125, 0.5, 0.25},
+		},
+		"transformation": {
+			geo: func(order binary.ByteOrder) []testTiffField {
+				return []testTiffField{{tagTransformation, 12, 16, testDoubles(order, 0.5, 0, 0, -10, 0, -0.25, 0, 20, 0, 0, 0, 0, 0, 0, 0, 1)}}
+			},
+			want: georeference{-10, 20, 0.5, 0.25},
+		},
+		"rotated": {
+			geo: func(order binary.ByteOrder) []testTiffField {
+				return []testTiffField{{tagTransformation, 12, 16, testDoubles(order, 0.5, 0.1, 0, -10, 0, -0.25, 0, 20, 0, 0, 0, 0, 0, 0, 0, 1)}}
+			},
+			err: "rotated",
+		},
+		"projected": {
+			geo: func(order binary.ByteOrder) []testTiffField {
+				return append(defaultTestGeo(order)[:2], testTiffField{tagGeoKeyDirectory, 3, 8, testShorts(order, 1, 1, 0, 1, geoKeyModelType, 0, 1, modelProjected)})
+			},
+			err: "projected",
+		},
+		"missing": {
+			geo: func(order binary.ByteOrder) []testTiffField { return nil },
+			err: "isn't georeferenced",
+		},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			tt := testTiff{order: binary.LittleEndian, bits: 8, format: 1, compression: 1, predictor: 1, samples: 1, rowsPerStrip: 8, geo: c.geo}
+			raster, err := openGeoTiff(writeTestTiff(t, tt))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want one containing %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raster.Close()
+			got := georeference{raster.originLng, raster.originLat, raster.scaleLng, raster.scaleLat}
+			if got != c.want {
+				t.Fatalf("georeference is %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestGeoTiffNoData(t *testing.T) {
+	tt := testTiff{order: binary.LittleEndian, bits: 16, format: 2, compression: 1, predictor: 1, samples: 1, rowsPerStrip: 8, noData: "-100"}
+	raster, err := openGeoTiff(writeTestTiff(t, tt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raster.Close()
+	if !raster.hasNoData || raster.noData != -100 {
+		t.Fatalf("nodata is %g (set %v), want -100", raster.noData, raster.hasNoData)
+	}
+}
+
+func TestLzwDecodeLongInput(t *testing.T) {
+	// long enough for the codes to reach 12 bits and the table to be cleared
+	random := rand.New(rand.NewSource(1))
+	src := make([]byte, 100000)
+	for i := range src {
+		src[i] = byte(random.Intn(16))
+	}
+	out, err := lzwDecode(testLzwEncode(src), len(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, src) {
+		t.Fatalf("decoded %d bytes that differ from the %d encoded", len(out), len(src))
+	}
+}
+
+func TestPackBitsDecode(t *testing.T) {
+	// the example from the TIFF 6.0 specification
+	packed := []byte{0xFE, 0xAA, 0x02, 0x80, 0x00, 0x2A, 0xFD, 0xAA, 0x03, 0x80, 0x00, 0x2A, 0x22, 0xF7, 0xAA}
+	want := []byte{
+		0xAA, 0xAA, 0xAA, 0x80, 0x00, 0x2A, 0xAA, 0xAA, 0xAA, 0xAA, 0x80, 0x00, 0x2A, 0x22,
+		0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA,
+	}
+	if got := packBitsDecode(packed, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("got % X, want % X", got, want)
+	}
+}
+
+func TestRasterToPopMap(t *testing.T) {
+	tt := testTiff{order: binary.LittleEndian, bits: 32, format: 3, compression: 8, predictor: 3, samples: 1, tileSize: 16, noData: "42.5"}
+	filePath := writeTestTiff(t, tt)
+	want := 0.0
+	for y := 0; y < testTiffHeight; y++ {
+		for x := 0; x < testTiffWidth; x++ {
+			if v := testTiffValue(x, y, 0, tt.format); v > 0 && v != 42.5 {
+				want += v
+			}
+		}
+	}
+
+	for _, areaWeighted := range []bool{false, true} {
+		popMap, err := RasterToPopMap(filePath, 4, areaWeighted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0.0
+		for _, pop := range popMap {
+			got += pop
+		}
+		if math.Abs(got-want) > 1e-6*want {
+			t.Errorf("area weighted %v: popmap holds %g, want %g", areaWeighted, got, want)
+		}
+	}
+}
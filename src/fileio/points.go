@@ -0,0 +1,173 @@
+package fileio
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// PointColumns names the fields of a points file. Without a Weight column
+// every point weighs 1.
+type PointColumns struct {
+	Lat    string
+	Lng    string
+	Weight string
+}
+
+// PointsToPopMap bins the points of a CSV (with a header row) or NDJSON file
+// into tiles at resolution, summing their weights. Rows with an empty
+// coordinate or weight are skipped.
+func PointsToPopMap(filePath string, resolution int, columns PointColumns) (project_types.PopMap, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	popMap := project_types.PopMap{}
+	points, skipped := 0, 0
+	add := func(line int, field func(name string) (string, bool)) error {
+		values := [3]float64{1, 0, 0} // weight, lat, lng
+		for i, name := range []string{columns.Weight, columns.Lat, columns.Lng} {
+			if name == "" {
+				continue
+			}
+			text, ok := field(name)
+			if !ok {
+				return fmt.Errorf("line %d has no %s field", line, name)
+			}
+			if text == "" {
+				skipped++
+				return nil
+			}
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return fmt.Errorf("line %d: %s %q is not a number", line, name, text)
+			}
+			values[i] = value
+		}
+		weight, lat, lng := values[0], values[1], values[2]
+		if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			return fmt.Errorf("line %d: %g, %g is not a valid lat, lng", line, lat, lng)
+		}
+		popMap[h3.FromGeo(h3.GeoCoord{Latitude: lat, Longitude: lng}, resolution)] += weight
+		points++
+		return nil
+	}
+
+	if strings.HasSuffix(strings.ToLower(filePath), ".csv") {
+		err = readCsvPoints(file, add)
+	} else {
+		err = readNdjsonPoints(file, add)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	log.Printf("%d points in %d tiles, %d rows skipped for empty values\n", points, len(popMap), skipped)
+	return popMap, nil
+}
+
+func readCsvPoints(file io.Reader, add func(int, func(string) (string, bool)) error) error {
+	reader := csv.NewReader(file)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return errors.New("no header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		field := func(name string) (string, bool) {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return "", false
+			}
+			return strings.TrimSpace(record[i]), true
+		}
+		if err := add(line, field); err != nil {
+			return err
+		}
+	}
+}
+
+func readNdjsonPoints(file io.Reader, add func(int, func(string) (string, bool)) error) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		object := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(text), &object); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		// numbers are usually numbers, but exports sometimes quote them
+		field := func(name string) (string, bool) {
+			switch value := object[name].(type) {
+			case float64:
+				return strconv.FormatFloat(value, 'g', -1, 64), true
+			case string:
+				return strings.TrimSpace(value), true
+			case nil:
+				_, ok := object[name]
+				return "", ok
+			}
+			return fmt.Sprint(object[name]), true
+		}
+		if err := add(line, field); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// SmoothPopMap spreads every tile's population over the tiles within k rings
+// of it with a triangular kernel: a tile d rings away gets a share
+// proportional to k+1-d. Totals are preserved.
+func SmoothPopMap(popMap project_types.PopMap, k int) project_types.PopMap {
+	if k <= 0 {
+		return popMap
+	}
+	tiles := make([]h3.H3Index, 0, len(popMap))
+	for tile := range popMap {
+		tiles = append(tiles, tile)
+	}
+	sort.Slice(tiles, func(i, j int) bool { return tiles[i] < tiles[j] })
+
+	smoothed := project_types.PopMap{}
+	for _, tile := range tiles {
+		rings := h3.KRingDistances(tile, k)
+		total := 0.0
+		for d, ring := range rings {
+			total += float64(k+1-d) * float64(len(ring))
+		}
+		for d, ring := range rings {
+			share := popMap[tile] * float64(k+1-d) / total
+			for _, neighbor := range ring {
+				smoothed[neighbor] += share
+			}
+		}
+	}
+	return smoothed
+}
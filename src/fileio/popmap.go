@@ -0,0 +1,144 @@
+package fileio
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+const (
+	SplitUniform = "uniform" // every child gets the same share of its parent
+	SplitCenter  = "center"  // the center child gets all of its parent
+	SplitWeights = "weights" // children get shares proportional to a weights popmap
+)
+
+func ParseSplitScheme(scheme string) (string, error) {
+	switch scheme {
+	case SplitUniform, SplitCenter, SplitWeights:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unknown split scheme %q, use %s, %s or %s", scheme, SplitUniform, SplitCenter, SplitWeights)
+}
+
+// PopMapResolution returns the resolution all tiles of popMap share
+func PopMapResolution(popMap project_types.PopMap) (int, error) {
+	resolution := -1
+	for tile := range popMap {
+		r := h3.Resolution(tile)
+		if resolution == -1 {
+			resolution = r
+		} else if r != resolution {
+			return 0, fmt.Errorf("popmap mixes resolutions %d and %d", resolution, r)
+		}
+	}
+	if resolution == -1 {
+		return 0, fmt.Errorf("popmap is empty")
+	}
+	return resolution, nil
+}
+
+// ConvertPopMap moves popMap to resolution. Going coarser, every tile adds its
+// population to its parent. Going finer, every tile's population is split
+// over its children by scheme. With SplitWeights the children share in
+// proportion to their population in weights, a popmap at resolution; a tile
+// whose children all weigh nothing is split uniformly.
+func ConvertPopMap(popMap project_types.PopMap, resolution int, scheme string, weights project_types.PopMap) (project_types.PopMap, error) {
+	from, err := PopMapResolution(popMap)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == SplitWeights && resolution > from {
+		if weightsResolution, err := PopMapResolution(weights); err != nil {
+			return nil, fmt.Errorf("weights: %w", err)
+		} else if weightsResolution != resolution {
+			return nil, fmt.Errorf("weights popmap has resolution %d, not %d", weightsResolution, resolution)
+		}
+	}
+
+	converted := project_types.PopMap{}
+	if resolution <= from {
+		for tile, pop := range popMap {
+			converted[h3.ToParent(tile, resolution)] += pop
+		}
+		return converted, nil
+	}
+
+	unweighted := 0
+	for tile, pop := range popMap {
+		if pop == 0 {
+			continue
+		}
+		if scheme == SplitCenter {
+			converted[h3.ToCenterChild(tile, resolution)] += pop
+			continue
+		}
+		children := h3.ToChildren(tile, resolution)
+		if scheme == SplitWeights {
+			total := 0.0
+			for _, child := range children {
+				total += weights[child]
+			}
+			if total > 0 {
+				for _, child := range children {
+					converted[child] += pop * weights[child] / total
+				}
+				continue
+			}
+			unweighted++
+		}
+		for _, child := range children {
+			converted[child] += pop / float64(len(children))
+		}
+	}
+	if unweighted > 0 {
+		log.Printf("%d populated tiles have no weight under them and were split uniformly\n", unweighted)
+	}
+	return converted, nil
+}
+
+// PopMapByCountry sums popMap by country. popMap may be finer than
+// h3ToCountry, its tiles then count for the country of their parent. It also
+// returns the populated tiles that are in no country.
+func PopMapByCountry(popMap project_types.PopMap, h3ToCountry project_types.H3ToCountry) (map[string]float64, project_types.PopMap, error) {
+	countryResolution := -1
+	for tile := range h3ToCountry {
+		countryResolution = h3.Resolution(tile)
+		break
+	}
+	totals := map[string]float64{}
+	unmatched := project_types.PopMap{}
+	for tile, pop := range popMap {
+		if pop == 0 {
+			continue
+		}
+		if resolution := h3.Resolution(tile); resolution < countryResolution {
+			return nil, nil, fmt.Errorf("popmap resolution %d is coarser than the country maps' %d", resolution, countryResolution)
+		} else if resolution > countryResolution && countryResolution >= 0 {
+			tile = h3.ToParent(tile, countryResolution)
+		}
+		if country, ok := h3ToCountry[tile]; ok {
+			totals[country] += pop
+		} else {
+			unmatched[tile] += pop
+		}
+	}
+	return totals, unmatched, nil
+}
+
+// SortedByPopulation returns the keys of pops from most to least populated
+func SortedByPopulation[K comparable](pops map[K]float64, less func(a K, b K) bool) []K {
+	keys := make([]K, 0, len(pops))
+	for key := range pops {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if pops[keys[i]] != pops[keys[j]] {
+			return pops[keys[i]] > pops[keys[j]]
+		}
+		return less(keys[i], keys[j])
+	})
+	return keys
+}
@@ -0,0 +1,79 @@
+package fileio
+
+import (
+	"log"
+	"math"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+const (
+	kmPerDegree = 111.32
+	// maxPixelSamples caps how many points a side of a pixel is split into
+	// when it is spread over the tiles it covers
+	maxPixelSamples = 16
+)
+
+// RasterToPopMap builds a popmap at resolution from a population GeoTIFF
+// such as WorldPop or GHSL in lat/lng. Each pixel's population goes to the
+// tile containing its center, or with areaWeighted it is split over the tiles
+// it covers by sampling points across the pixel. Pixels without data are skipped.
+func RasterToPopMap(filePath string, resolution int, areaWeighted bool) (project_types.PopMap, error) {
+	raster, err := openGeoTiff(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer raster.Close()
+	log.Printf("raster is %d x %d pixels of %g x %g degrees\n", raster.width, raster.height, raster.scaleLng, raster.scaleLat)
+
+	edgeKm := h3.EdgeLengthKm(resolution)
+	popMap := project_types.PopMap{}
+	skipped := 0
+	total := 0.0
+	err = raster.eachChunk(func(x0 int, y0 int, values []float64) error {
+		rows := len(values) / raster.chunkWidth
+		for row := 0; row < rows; row++ {
+			y := y0 + row
+			lat := raster.originLat - (float64(y)+0.5)*raster.scaleLat
+			samples := 1
+			if areaWeighted {
+				// points closer together than half a tile edge catch every tile the pixel touches
+				pixelKm := math.Max(raster.scaleLng*kmPerDegree*math.Cos(lat*math.Pi/180), raster.scaleLat*kmPerDegree)
+				samples = int(math.Min(math.Ceil(2*pixelKm/edgeKm), maxPixelSamples))
+				if samples < 1 {
+					samples = 1
+				}
+			}
+			for col := 0; col < raster.chunkWidth && x0+col < raster.width; col++ {
+				value := values[row*raster.chunkWidth+col]
+				if math.IsNaN(value) || (raster.hasNoData && value == raster.noData) || value <= 0 {
+					skipped++
+					continue
+				}
+				total += value
+				x := x0 + col
+				share := value / float64(samples*samples)
+				for i := 0; i < samples; i++ {
+					for j := 0; j < samples; j++ {
+						lng := raster.originLng + (float64(x)+(float64(i)+0.5)/float64(samples))*raster.scaleLng
+						if lng > 180 {
+							lng -= 360
+						}
+						coord := h3.GeoCoord{
+							Latitude:  raster.originLat - (float64(y)+(float64(j)+0.5)/float64(samples))*raster.scaleLat,
+							Longitude: lng,
+						}
+						popMap[h3.FromGeo(coord, resolution)] += share
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%.0f population in %d tiles, %d pixels without data or population\n", total, len(popMap), skipped)
+	return popMap, nil
+}
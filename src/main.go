@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"runtime"
 	"strings"
 	"sync"
@@ -17,6 +18,7 @@ import (
 	"github.com/mappichat/regions-engine/src/project_types"
 	"github.com/mappichat/regions-engine/src/server"
 	"github.com/mappichat/regions-engine/src/utils"
+	h3 "github.com/uber/h3-go/v3"
 )
 
 func main() {
@@ -25,7 +27,7 @@ func main() {
 	var err error
 	// utils.ConfigureEnv()
 	if len(os.Args) < 2 {
-		log.Fatal("run using one of these subcommands: generate, serve, dbwrite")
+		log.Fatal("run using one of these subcommands: generate, serve, export, tune, validate-config, popmap, dbwrite")
 	}
 
 	var countryPolygons project_types.CountryPolygons
@@ -45,27 +47,174 @@ func main() {
 		var configPath string
 		var outDir string
 		var memsafeStitching bool
+		var deterministic bool
+		var seed int64
+		var prevDir string
+		var formatFlag string
+		var minOverlap float64
+		var minShare float64
+		var checkpointDir string
+		var resume bool
+		var crossBorderFrom int
+		var adminPath string
+		var nameProperty string
+		var contestedMode string
+		var coastFill int
+		var oceanMode string
+		var oceanDistance float64
+		var contestedPriority string
+		var idProperty string
+		var adminProperty string
+		var weightsFlag string
 		cmd.IntVar(&resolution, "r", 5, "h3 resolution used to generate regions")
 		cmd.StringVar(&popMapPath, "p", "", "path to popmap file (json)")
 		cmd.StringVar(&configPath, "c", "", "path to engine config file (json)")
 		cmd.StringVar(&outDir, "o", "", "data output directory")
 		cmd.BoolVar(&memsafeStitching, "m", false, "Stitch country level data together one level at a time instead of concurrently. This can prevent crashes from using too much memory at higher resolutions. (Typically >= 7)")
+		cmd.BoolVar(&deterministic, "d", false, "Visit regions in a fixed order so identical inputs always produce identical output. Slower than the default.")
+		cmd.Int64Var(&seed, "s", 0, "seed used to break ties between equal candidates in deterministic mode (implies -d when non-zero)")
+		cmd.StringVar(&prevDir, "prev", "", "data directory of a previous generation. Regions that overlap a previous region keep its id and lineage{N}.json files are written")
+		cmd.Float64Var(&minOverlap, "prev-overlap", 0.5, "fraction of shared tiles (relative to the larger region) needed to keep a previous region id")
+		cmd.Float64Var(&minShare, "prev-share", engine.DefaultLineageMinShare, "fraction of a previous region's tiles a new region needs to be reported as a split or merge of it in lineage{N}.json")
+		cmd.StringVar(&formatFlag, "f", string(fileio.LevelFormatBinary), "level output format: binary (level{N}.bin), json (level{N}.json + parents{N}.json) or both")
+		cmd.StringVar(&checkpointDir, "checkpoint", "", "directory finished levels are checkpointed to while generating (default [output directory]/checkpoint)")
+		cmd.BoolVar(&resume, "resume", false, "continue from the checkpoint of an interrupted run with the same inputs and options")
+		cmd.IntVar(&crossBorderFrom, "cross-border", -1, "first level whose regions may cross country borders, using the global tile adjacency. Levels from it on are generated as one area instead of per country. -1 keeps every level inside its country")
+		cmd.StringVar(&nameProperty, "name-property", "ADMIN", "feature property holding a country's display name, such as ADMIN, NAME or name:en")
+		cmd.StringVar(&idProperty, "id-property", "", "feature property holding a stable country code, such as ISO_A3, that country maps are keyed by. Without it, or where it is -99, the display name is used")
+		cmd.StringVar(&contestedMode, "contested", engine.ContestedPriority, "who gets tiles covered by several countries' polygons: priority (first in -contested-priority, then by country code), largest (the country covering most of the tile) or disputed (a separate \""+engine.DisputedCountry+"\" country). Every contested tile is listed in contested.json")
+		cmd.StringVar(&contestedPriority, "contested-priority", "", "comma separated country codes in the order they win contested tiles")
+		cmd.IntVar(&coastFill, "coast-fill", 1, "rings of unassigned tiles around every country that are given to it as coastline")
+		cmd.StringVar(&oceanMode, "ocean", engine.OceanUnassigned, "what ocean tiles past the coast fill get: unassigned (nothing), nearest (the nearest country) or waters (territorial water regions of the nearest country). Ocean tiles are listed in oceanTiles.json")
+		cmd.Float64Var(&oceanDistance, "ocean-distance", 22.2, "how far ocean tiles are assigned from a country, in km (22.2 is the 12 nautical mile territorial sea)")
+		cmd.StringVar(&adminPath, "admin1", "", "path to an admin-1 (states, provinces) geojson file, used by levels with adminBoundary set")
+		cmd.StringVar(&adminProperty, "admin1-property", "name", "feature property holding the admin-1 area name")
+		cmd.StringVar(&weightsFlag, "weights", "", "comma separated weights regions carry besides population, as name=popmap-path, such as dau=dau.json. \""+engine.AreaWeight+"\" without a path is every tile's area in km². Levels limit them with weights and balance them with objective")
 		cmd.Parse(os.Args[3:])
 
+		format, err := fileio.ParseLevelFormat(formatFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ordering := engine.Ordering{Deterministic: deterministic || seed != 0, Seed: seed}
+		contested := engine.ContestedPolicy{}
+		if contested.Mode, err = engine.ParseContestedMode(contestedMode); err != nil {
+			log.Fatal(err)
+		}
+		ocean := engine.OceanPolicy{MaxDistance: oceanDistance}
+		if ocean.Mode, err = engine.ParseOceanMode(oceanMode); err != nil {
+			log.Fatal(err)
+		}
+		if coastFill < 0 {
+			log.Fatal(errors.New("-coast-fill can't be negative"))
+		}
+		if contestedPriority != "" {
+			for _, country := range strings.Split(contestedPriority, ",") {
+				contested.Priority = append(contested.Priority, strings.TrimSpace(country))
+			}
+		}
+
 		if outDir == "" {
 			outDir = fmt.Sprintf("./resolution%d-data/", resolution)
 		}
 
+		// catch bad configs before hours of generating
+		var options project_types.EngineOptions
+		if configPath != "" {
+			options, err = fileio.LoadOptions(configPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			if _, ok := utils.DefaultOptions[resolution]; !ok {
+				log.Fatal(errors.New("if resolution isn't [5-7] you must specify your own config file with -c"))
+			} else {
+				options = utils.DefaultOptions[resolution]
+			}
+		}
+		if err := engine.ValidateOptions(options, resolution, crossBorderFrom); err != nil {
+			log.Fatal(err)
+		}
+		if adminPath == "" {
+			for i, o := range options {
+				if o.AdminBoundary != "" {
+					log.Fatalf("level %d has adminBoundary %q but no admin-1 file was given with -admin1", i, o.AdminBoundary)
+				}
+			}
+		}
+		weightPaths := map[string]string{}
+		if weightsFlag != "" {
+			for _, weight := range strings.Split(weightsFlag, ",") {
+				name, weightPath, _ := strings.Cut(strings.TrimSpace(weight), "=")
+				if name == "" || name == project_types.PopulationWeight {
+					log.Fatalf("-weights has %q, weights need a name other than %s", weight, project_types.PopulationWeight)
+				}
+				if weightPath == "" && name != engine.AreaWeight {
+					log.Fatalf("weight %s has no popmap path, only %s can be left without one", name, engine.AreaWeight)
+				}
+				if _, ok := weightPaths[name]; ok {
+					log.Fatalf("weight %s is given twice", name)
+				}
+				weightPaths[name] = weightPath
+			}
+		}
+		for _, name := range engine.WeightNames(options) {
+			if _, ok := weightPaths[name]; !ok {
+				log.Fatalf("config uses weight %s but it isn't given with -weights", name)
+			}
+		}
+
 		log.Print("loading countries geojson data")
-		countryPolygons, err = fileio.ReadCountriesFile(countriesPath)
+		var countryNames project_types.CountryNames
+		countryPolygons, countryNames, err = fileio.ReadAreasFile(countriesPath, nameProperty, idProperty)
 		if err != nil {
 			log.Fatal(err)
 		}
 		log.Print("generating country maps")
-		h3ToCountry, countryToH3 = engine.GenerateCountryMaps(countryPolygons, resolution, 1)
+		for _, country := range contested.Priority {
+			if _, ok := countryPolygons[country]; !ok {
+				log.Printf("warning: %s in -contested-priority is not a country of %s\n", country, countriesPath)
+			}
+		}
+		var contestedTiles []project_types.ContestedTile
+		h3ToCountry, countryToH3, contestedTiles = engine.GenerateCountryMaps(countryPolygons, resolution, coastFill, ordering, contested)
+		oceanTiles := engine.AssignOcean(h3ToCountry, countryToH3, ocean, ordering)
+		if ocean.Mode == engine.OceanWaters {
+			for country, name := range countryNames {
+				if _, ok := countryToH3[engine.WatersCountry(country)]; ok {
+					countryNames[engine.WatersCountry(country)] = name + " territorial waters"
+				}
+			}
+		}
+
+		oceanSet := make(map[h3.H3Index]bool, len(oceanTiles))
+		for _, tile := range oceanTiles {
+			oceanSet[tile] = true
+		}
+		for i, o := range options {
+			if o.ExcludeOceanFromSize && len(oceanTiles) == 0 {
+				log.Printf("warning: level %d excludes ocean tiles from region sizes but no ocean tiles were assigned, see -ocean\n", i)
+			}
+		}
+
+		var h3ToAdmin project_types.H3ToAdmin
+		if adminPath != "" {
+			log.Print("loading admin-1 geojson data")
+			adminPolygons, _, err := fileio.ReadAreasFile(adminPath, adminProperty, "")
+			if err != nil {
+				log.Fatal(err)
+			}
+			h3ToAdmin = engine.GenerateAdminMap(adminPolygons, resolution, ordering)
+		}
 
 		log.Print("writing country maps to json")
-		if err = fileio.WriteCountryMaps(countryPolygons, countryToH3, h3ToCountry, outDir); err != nil {
+		if err = fileio.WriteCountryMaps(countryPolygons, countryToH3, h3ToCountry, countryNames, outDir); err != nil {
+			log.Fatal(err)
+		}
+		if err = utils.WriteAsJsonFile(contestedTiles, path.Join(outDir, "contested.json")); err != nil {
+			log.Fatal(err)
+		}
+		if err = utils.WriteAsJsonFile(project_types.H3Strings(oceanTiles), path.Join(outDir, "oceanTiles.json")); err != nil {
 			log.Fatal(err)
 		}
 
@@ -84,22 +233,31 @@ func main() {
 		mean, std := fileio.PopMapStats(popMap)
 		log.Printf("popmap mean: %f, standard deviation: %f\n", mean, std)
 
-		var options project_types.EngineOptions
-		if configPath != "" {
-			options, err = fileio.LoadOptions(configPath)
-			if err != nil {
-				log.Fatal(err)
+		weightMaps := project_types.WeightMaps{}
+		for name, weightPath := range weightPaths {
+			if weightPath == "" {
+				log.Printf("calculating %s weights from tile areas\n", name)
+				weightMaps[name] = engine.TileAreas(h3ToCountry)
+				continue
 			}
-		} else {
-			if _, ok := utils.DefaultOptions[resolution]; !ok {
-				log.Fatal(errors.New("if resolution isn't [5-7] you must specify your own config file with -c"))
-			} else {
-				options = utils.DefaultOptions[resolution]
+			log.Printf("loading %s weights\n", name)
+			if weightMaps[name], err = fileio.LoadWeightMap(weightPath, resolution); err != nil {
+				log.Fatal(err)
 			}
 		}
 
 		log.Print("generating levels")
-		err = engine.GenerateAndWriteLevels(popMap, countryToH3, outDir, resolution, memsafeStitching, options)
+		err = engine.GenerateAndWriteLevels(popMap, countryToH3, outDir, resolution, options, engine.GenerateOptions{
+			WeightMaps:          weightMaps,
+			Admin:               h3ToAdmin,
+			Ocean:               oceanSet,
+			CrossBorderFrom:     crossBorderFrom,
+			Format:              format,
+			Ordering:            ordering,
+			Lineage:             engine.LineageOptions{PrevDir: prevDir, MinOverlap: minOverlap, MinShare: minShare},
+			Checkpoint:          engine.CheckpointOptions{Dir: checkpointDir, Resume: resume},
+			MemorySafeStitching: memsafeStitching,
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -113,20 +271,326 @@ func main() {
 
 		cmd := flag.NewFlagSet("serve", flag.ExitOnError)
 		var port int
+		auth := server.AuthOptions{}
 		cmd.IntVar(&port, "p", 8080, "serving port")
+		cmd.StringVar(&auth.JwksURL, "jwks-url", "", "JWKS url used to verify bearer tokens. Auth is disabled unless this or -jwt-secret is set")
+		cmd.StringVar(&auth.StaticSecret, "jwt-secret", "", "HMAC secret used to verify bearer tokens instead of a JWKS (for local testing)")
+		cmd.StringVar(&auth.Audience, "jwt-audience", "", "required token audience")
+		cmd.StringVar(&auth.Issuer, "jwt-issuer", "", "required token issuer")
+		cmd.DurationVar(&auth.RefreshInterval, "jwks-refresh", time.Hour, "how often to refresh the JWKS")
+		reload := server.ReloadOptions{}
+		cmd.DurationVar(&reload.WatchInterval, "watch", 0, "check the data directory for changes on this interval and reload them (e.g. 30s). Disabled by default")
+		cmd.StringVar(&reload.AdminToken, "admin-token", "", "token required in the X-Admin-Token header of POST /reload. Without it POST /reload is disabled")
+		cmd.Parse(os.Args[3:])
+
+		server.RunServer(dataDir, port, auth, reload)
+	case "export":
+		if len(os.Args) < 3 {
+			log.Fatal("export subcommand has one argument: [data-directory]")
+		}
+		dataDir := os.Args[2]
+
+		cmd := flag.NewFlagSet("export", flag.ExitOnError)
+		var outDir string
+		cmd.StringVar(&outDir, "o", "", "geojson output directory (defaults to the data directory)")
+		cmd.Parse(os.Args[3:])
+
+		if outDir == "" {
+			outDir = dataDir
+		}
+
+		log.Print("exporting levels to geojson")
+		if err = fileio.ExportLevelsGeoJson(dataDir, outDir); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Print(time.Since(startTime))
+	case "validate-config":
+		if len(os.Args) < 3 {
+			log.Fatal("validate-config subcommand has one argument: [config-path]")
+		}
+		configPath := os.Args[2]
+
+		cmd := flag.NewFlagSet("validate-config", flag.ExitOnError)
+		var resolution int
+		var crossBorderFrom int
+		cmd.IntVar(&resolution, "r", 5, "h3 resolution the config will be used with")
+		cmd.IntVar(&crossBorderFrom, "cross-border", -1, "first level the config will be generated across country borders from, as with generate -cross-border")
+		cmd.Parse(os.Args[3:])
+
+		options, err := fileio.LoadOptions(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := engine.ValidateOptions(options, resolution, crossBorderFrom); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s is valid for resolution %d (%d levels)\n", configPath, resolution, len(options))
+	case "tune":
+		if len(os.Args) < 3 {
+			log.Fatal("tune subcommand has one argument: [popmap-path]")
+		}
+		popMapPath := os.Args[2]
+
+		cmd := flag.NewFlagSet("tune", flag.ExitOnError)
+		var resolution int
+		var levels int
+		var branching float64
+		var quantile float64
+		var outPath string
+		var sampleSize int
+		cmd.IntVar(&resolution, "r", 5, "h3 resolution of the popmap")
+		cmd.IntVar(&levels, "l", 6, "number of levels")
+		cmd.Float64Var(&branching, "b", 7, "how many regions of the level below every region should group (7 matches the h3 aperture)")
+		cmd.Float64Var(&quantile, "q", 0.75, "quantile of populated tiles' population that maxPopulation is scaled from")
+		cmd.StringVar(&outPath, "o", "", "config output path (default ./config-res[resolution].json)")
+		cmd.IntVar(&sampleSize, "check", 0, "generate the tuned levels over about this many tiles around the most populated one and log the result (0 skips the check)")
 		cmd.Parse(os.Args[3:])
 
-		log.Print("reading country maps from json")
-		countryPolygons, countryToH3, h3ToCountry, err = fileio.ReadCountryMaps(dataDir)
+		if outPath == "" {
+			outPath = fmt.Sprintf("./config-res%d.json", resolution)
+		}
+
+		log.Print("loading popmap")
+		popMap, err := fileio.LoadPopMapJson(popMapPath, resolution)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mean, std := fileio.PopMapStats(popMap)
+		quantiles := fileio.PopMapQuantiles(popMap, []float64{0.25, 0.5, quantile, 0.99})
+		log.Printf("popmap mean: %f, standard deviation: %f\n", mean, std)
+		log.Printf("populated tiles: 25%% %.1f, median %.1f, %.0f%% %.1f, 99%% %.1f\n", quantiles[0], quantiles[1], quantile*100, quantiles[2], quantiles[3])
+
+		options, err := engine.TuneOptions(resolution, levels, branching, quantiles[2])
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Print("reading levels and parents from json files")
-		levels, parents := fileio.ReadLevels(dataDir)
+		if err := engine.ValidateOptions(options, resolution, -1); err != nil {
+			log.Fatal(err)
+		}
+		if sampleSize > 0 {
+			if err := engine.SampleLevels(popMap, sampleSize, branching, options); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Printf("writing config to %s\n", outPath)
+		if err := utils.WriteAsJsonFile(options, outPath); err != nil {
+			log.Fatal(err)
+		}
 
 		log.Print(time.Since(startTime))
+	case "popmap":
+		if len(os.Args) < 3 {
+			log.Fatal("popmap subcommand has one of these subcommands: from-raster, from-points, convert, stats")
+		}
+		switch os.Args[2] {
+		case "from-raster":
+			if len(os.Args) < 4 {
+				log.Fatal("popmap from-raster has one argument: [geotiff-path]")
+			}
+			rasterPath := os.Args[3]
+
+			cmd := flag.NewFlagSet("popmap from-raster", flag.ExitOnError)
+			var resolution int
+			var method string
+			var outPath string
+			cmd.IntVar(&resolution, "r", 5, "h3 resolution of the popmap")
+			cmd.StringVar(&method, "method", "centroid", "how pixels are distributed: centroid (to the tile containing the pixel center) or area (split over the tiles the pixel covers)")
+			cmd.StringVar(&outPath, "o", "", "popmap output path (default ./popmap[resolution].json)")
+			cmd.Parse(os.Args[4:])
+
+			if method != "centroid" && method != "area" {
+				log.Fatalf("unknown method %q, use centroid or area", method)
+			}
+			if _, ok := project_types.ResolutionSizes[resolution]; !ok {
+				log.Fatalf("invalid resolution %d", resolution)
+			}
+			if outPath == "" {
+				outPath = fmt.Sprintf("./popmap%d.json", resolution)
+			}
+
+			log.Print("reading raster")
+			popMap, err := fileio.RasterToPopMap(rasterPath, resolution, method == "area")
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("writing popmap to %s\n", outPath)
+			if err := utils.WriteAsJsonFile(popMap, outPath); err != nil {
+				log.Fatal(err)
+			}
+		case "from-points":
+			if len(os.Args) < 4 {
+				log.Fatal("popmap from-points has one argument: [csv-or-ndjson-path]")
+			}
+			pointsPath := os.Args[3]
+
+			cmd := flag.NewFlagSet("popmap from-points", flag.ExitOnError)
+			var resolution int
+			var columns fileio.PointColumns
+			var smoothing int
+			var outPath string
+			cmd.IntVar(&resolution, "r", 5, "h3 resolution of the popmap")
+			cmd.StringVar(&columns.Lat, "lat", "lat", "latitude column or field")
+			cmd.StringVar(&columns.Lng, "lng", "lng", "longitude column or field")
+			cmd.StringVar(&columns.Weight, "weight", "", "weight column or field (default every point weighs 1)")
+			cmd.IntVar(&smoothing, "smooth", 0, "spread every tile's weight over the tiles within this many rings of it (0 disables smoothing)")
+			cmd.StringVar(&outPath, "o", "", "popmap output path (default ./popmap[resolution].json)")
+			cmd.Parse(os.Args[4:])
+
+			if _, ok := project_types.ResolutionSizes[resolution]; !ok {
+				log.Fatalf("invalid resolution %d", resolution)
+			}
+			if outPath == "" {
+				outPath = fmt.Sprintf("./popmap%d.json", resolution)
+			}
+
+			log.Print("reading points")
+			popMap, err := fileio.PointsToPopMap(pointsPath, resolution, columns)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if smoothing > 0 {
+				log.Printf("smoothing over %d rings\n", smoothing)
+				popMap = fileio.SmoothPopMap(popMap, smoothing)
+			}
+			log.Printf("writing popmap to %s\n", outPath)
+			if err := utils.WriteAsJsonFile(popMap, outPath); err != nil {
+				log.Fatal(err)
+			}
+		case "convert":
+			if len(os.Args) < 4 {
+				log.Fatal("popmap convert has one argument: [popmap-path]")
+			}
+			popMapPath := os.Args[3]
+
+			cmd := flag.NewFlagSet("popmap convert", flag.ExitOnError)
+			var resolution int
+			var scheme string
+			var weightsPath string
+			var outPath string
+			cmd.IntVar(&resolution, "r", 5, "h3 resolution to convert the popmap to")
+			cmd.StringVar(&scheme, "split", fileio.SplitUniform, "how a tile is split over its children when converting to a finer resolution: uniform, center or weights")
+			cmd.StringVar(&weightsPath, "weights", "", "popmap at the target resolution whose population weighs the children (required by -split weights)")
+			cmd.StringVar(&outPath, "o", "", "popmap output path (default ./popmap[resolution].json)")
+			cmd.Parse(os.Args[4:])
+
+			if _, ok := project_types.ResolutionSizes[resolution]; !ok {
+				log.Fatalf("invalid resolution %d", resolution)
+			}
+			scheme, err := fileio.ParseSplitScheme(scheme)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if scheme == fileio.SplitWeights && weightsPath == "" {
+				log.Fatal("-split weights needs a -weights popmap")
+			}
+			if outPath == "" {
+				outPath = fmt.Sprintf("./popmap%d.json", resolution)
+			}
+
+			log.Print("reading popmap")
+			popMap := project_types.PopMap{}
+			if err := utils.ReadJsonFile(popMapPath, &popMap); err != nil {
+				log.Fatal(err)
+			}
+			weights := project_types.PopMap{}
+			if scheme == fileio.SplitWeights {
+				log.Print("reading weights")
+				if err := utils.ReadJsonFile(weightsPath, &weights); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			log.Printf("converting popmap to resolution %d\n", resolution)
+			converted, err := fileio.ConvertPopMap(popMap, resolution, scheme, weights)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("writing popmap to %s\n", outPath)
+			if err := utils.WriteAsJsonFile(converted, outPath); err != nil {
+				log.Fatal(err)
+			}
+		case "stats":
+			if len(os.Args) < 4 {
+				log.Fatal("popmap stats has one argument: [popmap-path]")
+			}
+			popMapPath := os.Args[3]
+
+			cmd := flag.NewFlagSet("popmap stats", flag.ExitOnError)
+			var resolution int
+			var countriesDir string
+			var top int
+			cmd.IntVar(&resolution, "r", 5, "h3 resolution of the popmap")
+			cmd.StringVar(&countriesDir, "countries", "", "output directory of a generate run whose country maps the population is totaled by")
+			cmd.IntVar(&top, "top", 20, "how many countries and unmatched tiles to list, most populated first (0 lists all)")
+			cmd.Parse(os.Args[4:])
+
+			log.Print("loading popmap")
+			popMap, err := fileio.LoadPopMapJson(popMapPath, resolution)
+			if err != nil {
+				log.Fatal(err)
+			}
+			total := 0.0
+			populated := 0
+			for _, pop := range popMap {
+				total += pop
+				if pop > 0 {
+					populated++
+				}
+			}
+			mean, std := fileio.PopMapStats(popMap)
+			quantiles := fileio.PopMapQuantiles(popMap, []float64{0, 0.25, 0.5, 0.75, 0.9, 0.99, 1})
+			log.Printf("total population: %.0f in %d populated tiles of %d\n", total, populated, len(popMap))
+			log.Printf("popmap mean: %f, standard deviation: %f\n", mean, std)
+			log.Printf("populated tiles: min %.1f, 25%% %.1f, median %.1f, 75%% %.1f, 90%% %.1f, 99%% %.1f, max %.1f\n", quantiles[0], quantiles[1], quantiles[2], quantiles[3], quantiles[4], quantiles[5], quantiles[6])
+
+			if countriesDir == "" {
+				break
+			}
+			log.Print("reading country maps")
+			_, _, h3ToCountry, countryNames, err := fileio.ReadCountryMaps(countriesDir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			totals, unmatched, err := fileio.PopMapByCountry(popMap, h3ToCountry)
+			if err != nil {
+				log.Fatal(err)
+			}
+			limit := func(n int) int {
+				if top > 0 && top < n {
+					return top
+				}
+				return n
+			}
+			share := func(pop float64) float64 {
+				if total == 0 {
+					return 0
+				}
+				return pop / total * 100
+			}
+			countries := fileio.SortedByPopulation(totals, func(a string, b string) bool { return a < b })
+			log.Printf("population of %d countries:\n", len(countries))
+			for _, country := range countries[:limit(len(countries))] {
+				name := country
+				if countryName, ok := countryNames[country]; ok && countryName != country {
+					name = fmt.Sprintf("%s (%s)", countryName, country)
+				}
+				log.Printf("  %s: %.0f (%.2f%%)\n", name, totals[country], share(totals[country]))
+			}
+			unmatchedTotal := 0.0
+			for _, pop := range unmatched {
+				unmatchedTotal += pop
+			}
+			log.Printf("%d populated tiles are in no country, population %.0f (%.2f%%)\n", len(unmatched), unmatchedTotal, share(unmatchedTotal))
+			tiles := fileio.SortedByPopulation(unmatched, func(a h3.H3Index, b h3.H3Index) bool { return a < b })
+			for _, tile := range tiles[:limit(len(tiles))] {
+				log.Printf("  %s: %.0f\n", h3.ToString(tile), unmatched[tile])
+			}
+		default:
+			log.Fatalf("unknown popmap subcommand %q, use from-raster, from-points, convert or stats", os.Args[2])
+		}
 
-		server.RunServer(levels, parents, h3ToCountry, countryToH3, countryPolygons, port)
 	case "dbwrite":
 		if len(os.Args) < 5 {
 			log.Fatal("dbwrite subcommand has three arguments: [sql-connection-string] [h3ToCountryPath] [levelPaths (comma seperated)]")
@@ -196,6 +660,6 @@ func main() {
 
 		log.Print(time.Since(startTime))
 	default:
-		log.Fatal("run using one of these subcommands: generate, serve, dbwrite")
+		log.Fatal("run using one of these subcommands: generate, serve, export, tune, validate-config, popmap, dbwrite")
 	}
 }
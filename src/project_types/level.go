@@ -0,0 +1,151 @@
+package project_types
+
+import (
+	"fmt"
+	"sort"
+
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// Level holds a level's regions sorted by Index, so RegionIDs are dense and
+// ordered the same way as the regions' h3 indexes.
+type Level []Region
+
+// RegionJson is the json form of a Region used in level{N}.json files
+type RegionJson struct {
+	Index      string          `json:"index"`
+	Population float64         `json:"population"`
+	Weights    Weights         `json:"weights,omitempty"`
+	Tiles      []string        `json:"tiles"`
+	Neighbors  map[string]bool `json:"neighbors"`
+	Centroid   h3.GeoCoord     `json:"centroid"`
+}
+
+type LevelJson map[string]RegionJson
+
+// SortLevel orders regions by Index and rewrites neighbor ids to match
+func SortLevel(level Level) Level {
+	order := make([]RegionID, len(level))
+	for i := range order {
+		order[i] = RegionID(i)
+	}
+	sort.Slice(order, func(i, j int) bool { return level[order[i]].Index < level[order[j]].Index })
+	newIDs := make([]RegionID, len(level))
+	for newID, oldID := range order {
+		newIDs[oldID] = RegionID(newID)
+	}
+
+	sorted := make(Level, len(level))
+	for newID, oldID := range order {
+		region := level[oldID]
+		neighbors := make([]RegionID, len(region.Neighbors))
+		for i, neighbor := range region.Neighbors {
+			neighbors[i] = newIDs[neighbor]
+		}
+		sort.Slice(neighbors, func(a, b int) bool { return neighbors[a] < neighbors[b] })
+		region.Neighbors = neighbors
+		sorted[newID] = region
+	}
+	return sorted
+}
+
+// Find returns the id of the region with the given index
+func (level Level) Find(index h3.H3Index) (RegionID, bool) {
+	i := sort.Search(len(level), func(i int) bool { return level[i].Index >= index })
+	if i < len(level) && level[i].Index == index {
+		return RegionID(i), true
+	}
+	return 0, false
+}
+
+// TileParents maps every tile in the level to the region containing it
+func (level Level) TileParents() map[h3.H3Index]RegionID {
+	parents := make(map[h3.H3Index]RegionID, LevelTotalTiles(level))
+	for id, region := range level {
+		for _, tile := range region.Tiles {
+			parents[tile] = RegionID(id)
+		}
+	}
+	return parents
+}
+
+func (level Level) ToJson() (LevelJson, map[string]string) {
+	levelJson := make(LevelJson, len(level))
+	parents := make(map[string]string, LevelTotalTiles(level))
+	for _, region := range level {
+		index := h3.ToString(region.Index)
+		neighbors := make(map[string]bool, len(region.Neighbors))
+		for _, neighbor := range region.Neighbors {
+			neighbors[h3.ToString(level[neighbor].Index)] = true
+		}
+		tiles := H3Strings(region.Tiles)
+		for _, tile := range tiles {
+			parents[tile] = index
+		}
+		levelJson[index] = RegionJson{
+			Index:      index,
+			Population: region.Population,
+			Weights:    region.Weights,
+			Tiles:      tiles,
+			Neighbors:  neighbors,
+			Centroid:   region.Centroid,
+		}
+	}
+	return levelJson, parents
+}
+
+func LevelFromJson(levelJson LevelJson) (Level, error) {
+	level := make(Level, 0, len(levelJson))
+	for key, region := range levelJson {
+		index := h3.FromString(key)
+		if index == 0 {
+			return nil, fmt.Errorf("region %q is not an h3 index", key)
+		}
+		level = append(level, Region{
+			Index:      index,
+			Population: region.Population,
+			Weights:    region.Weights,
+			Tiles:      H3Indexes(region.Tiles),
+			Centroid:   region.Centroid,
+		})
+	}
+	sort.Slice(level, func(i, j int) bool { return level[i].Index < level[j].Index })
+	for i := range level {
+		neighbors := levelJson[h3.ToString(level[i].Index)].Neighbors
+		level[i].Neighbors = make([]RegionID, 0, len(neighbors))
+		for neighbor := range neighbors {
+			id, ok := level.Find(h3.FromString(neighbor))
+			if !ok {
+				return nil, fmt.Errorf("region %s has unknown neighbor %s", h3.ToString(level[i].Index), neighbor)
+			}
+			level[i].Neighbors = append(level[i].Neighbors, id)
+		}
+		sort.Slice(level[i].Neighbors, func(a, b int) bool { return level[i].Neighbors[a] < level[i].Neighbors[b] })
+	}
+	return level, nil
+}
+
+func LevelTotalTiles(level Level) int {
+	sum := 0
+	for _, region := range level {
+		sum += len(region.Tiles)
+	}
+	return sum
+}
+
+func LevelTotalPop(level Level) float64 {
+	sum := 0.0
+	for _, region := range level {
+		sum += region.Population
+	}
+	return sum
+}
+
+// LevelTotalWeights sums every weight over the regions of level, nil if they have none
+func LevelTotalWeights(level Level) Weights {
+	var sum Weights
+	for _, region := range level {
+		sum = AddWeights(sum, region.Weights)
+	}
+	return sum
+}
@@ -1,29 +1,168 @@
 package project_types
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sort"
 
 	h3 "github.com/uber/h3-go/v3"
 )
 
+// RegionID is a region's position in its Level
+type RegionID int32
+
+// Region is the in-memory form of a region. Tiles and neighbors are kept as
+// h3 indexes and RegionIDs; strings are only used at the api and file
+// boundaries (see RegionJson).
 type Region struct {
-	Index      string          `json:"index"`
-	Population float64         `json:"population"`
-	Tiles      []string        `json:"tiles"`
-	Neighbors  map[string]bool `json:"neighbors"`
-	Centroid   h3.GeoCoord     `json:"centroid"`
+	Index      h3.H3Index
+	Population float64
+	Weights    Weights // nil unless the level was generated with weights
+	Tiles      []h3.H3Index
+	Neighbors  []RegionID // sorted
+	Centroid   h3.GeoCoord
 }
 
 // assumes regions are presorted by h3 index
 func NearestRegion(r *Region, h3SortedRegions []Region) *Region {
 	index := sort.Search(len(h3SortedRegions), func(i int) bool {
-		return h3.FromString(r.Index) > h3.FromString(h3SortedRegions[i].Index)
+		return r.Index > h3SortedRegions[i].Index
 	})
 	return &h3SortedRegions[index]
 }
 
-type PopMap map[string]float64
+// PopMap is keyed by h3 index in memory and by h3 string in json
+type PopMap map[h3.H3Index]float64
+
+func (p PopMap) MarshalJSON() ([]byte, error) {
+	out := make(map[string]float64, len(p))
+	for h, pop := range p {
+		out[h3.ToString(h)] = pop
+	}
+	return json.Marshal(out)
+}
+
+func (p *PopMap) UnmarshalJSON(data []byte) error {
+	in := map[string]float64{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if *p == nil {
+		*p = make(PopMap, len(in))
+	}
+	for tile, pop := range in {
+		h := h3.FromString(tile)
+		if h == 0 {
+			return fmt.Errorf("popmap key %q is not an h3 index", tile)
+		}
+		(*p)[h] = pop
+	}
+	return nil
+}
+
+// PopulationWeight names a region's population in LevelOptions.Objective
+const PopulationWeight = "population"
+
+// Weight is one named weight of a region
+type Weight struct {
+	Name  string
+	Value float64
+}
+
+// Weights are named weights a region carries besides its population, such as
+// daily active users or land area, sorted by name. Being a slice instead of a
+// map lets the regions of a level share one block of weights. In json they
+// are an object keyed by name.
+type Weights []Weight
+
+// WeightsFromMap sorts the weights of m by name
+func WeightsFromMap(m map[string]float64) Weights {
+	if len(m) == 0 {
+		return nil
+	}
+	weights := make(Weights, 0, len(m))
+	for name, value := range m {
+		weights = append(weights, Weight{Name: name, Value: value})
+	}
+	sort.Slice(weights, func(i, j int) bool { return weights[i].Name < weights[j].Name })
+	return weights
+}
+
+// Get returns the weight called name, 0 if there is none
+func (w Weights) Get(name string) float64 {
+	if i := w.find(name); i < len(w) && w[i].Name == name {
+		return w[i].Value
+	}
+	return 0
+}
+
+// find returns where the weight called name is or would be inserted
+func (w Weights) find(name string) int {
+	return sort.Search(len(w), func(i int) bool { return w[i].Name >= name })
+}
+
+// Add adds value to the weight called name, inserting it if needed, and
+// returns w
+func (w Weights) Add(name string, value float64) Weights {
+	i := w.find(name)
+	if i < len(w) && w[i].Name == name {
+		w[i].Value += value
+		return w
+	}
+	w = append(w, Weight{})
+	copy(w[i+1:], w[i:])
+	w[i] = Weight{Name: name, Value: value}
+	return w
+}
+
+func (w Weights) MarshalJSON() ([]byte, error) {
+	if w == nil {
+		return []byte("null"), nil
+	}
+	m := make(map[string]float64, len(w))
+	for _, weight := range w {
+		m[weight.Name] = weight.Value
+	}
+	return json.Marshal(m)
+}
+
+func (w *Weights) UnmarshalJSON(data []byte) error {
+	m := map[string]float64{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*w = WeightsFromMap(m)
+	return nil
+}
+
+// AddWeights adds b to a, allocating a if needed, and returns it
+func AddWeights(a Weights, b Weights) Weights {
+	if len(b) == 0 {
+		return a
+	}
+	if a == nil {
+		return append(make(Weights, 0, len(b)), b...)
+	}
+	for i, weight := range b {
+		// regions of one level carry the same names, so they line up
+		if i < len(a) && a[i].Name == weight.Name {
+			a[i].Value += weight.Value
+		} else {
+			a = a.Add(weight.Name, weight.Value)
+		}
+	}
+	return a
+}
+
+// WeightMaps holds a popmap for every named weight, tiles missing from one weigh 0
+type WeightMaps map[string]PopMap
+
+// WeightLimits bound a weight of every region of a level, 0 disables a limit
+type WeightLimits struct {
+	Max float64 `json:"max"`
+	Min float64 `json:"min"`
+}
 
 type LevelOptions struct {
 	MaxRegionSize         int     `json:"maxRegionSize"`
@@ -31,13 +170,64 @@ type LevelOptions struct {
 	DistanceExponent      float64 `json:"distanceExponent"`
 	IslandDampeningPasses int     `json:"islandDampeningPasses"`
 	SmallRegionMergeLimit int     `json:"smallRegionMergeLimit"`
+	RefinementPasses      int     `json:"refinementPasses"` // population balancing passes after growth, 0 disables refinement
+	MinPop                float64 `json:"minPopulation"`
+	MinRegionSize         int     `json:"minRegionSize"`
+	// TargetRegionCount makes the engine search for the MaxPop and
+	// MaxRegionSize that produce about this many regions. Countries in
+	// CountryTargetRegionCounts are searched for separately and the rest share
+	// whatever is left of TargetRegionCount. Limits that are 0 start from the
+	// average a region needs to hit the target.
+	TargetRegionCount         int            `json:"targetRegionCount"`
+	CountryTargetRegionCounts map[string]int `json:"countryTargetRegionCounts"`
+	TargetTolerance           float64        `json:"targetTolerance"` // accepted relative difference from the target, 0.05 when unset
+	// AdminBoundary is "hard" to keep regions inside one admin-1 area, "soft"
+	// to only avoid crossing admin-1 boundaries, or empty to ignore them.
+	// Soft crossings divide a neighbor's growth priority by
+	// AdminCrossingPenalty, 4 when unset.
+	AdminBoundary        string  `json:"adminBoundary"`
+	AdminCrossingPenalty float64 `json:"adminCrossingPenalty"`
+	// ExcludeOceanFromSize leaves the ocean tiles the ocean policy assigned
+	// out of region sizes, so maxRegionSize, minRegionSize and
+	// smallRegionMergeLimit only count land tiles and coastal regions aren't
+	// cut smaller on land than inland ones.
+	ExcludeOceanFromSize bool `json:"excludeOceanFromSize"`
+	// Weights limits regions by the weights they carry besides population,
+	// keyed by weight name. Growth, merging and refinement keep regions under
+	// every Max; regions below a Min are merged like ones below MinPop.
+	Weights map[string]WeightLimits `json:"weights"`
+	// Objective is what regions grow towards evening out and refinement
+	// balances: the sum of every weight times its coefficient, "population"
+	// naming the population. Coefficients also convert between units, e.g.
+	// {"population": 1, "dau": 10}. Population alone when empty.
+	Objective map[string]float64 `json:"objective"`
 }
 
 type EngineOptions []LevelOptions
 
+// LevelMetadata records the options a level was actually generated with, which
+// differ from the configured ones when a target region count was searched for
+type LevelMetadata struct {
+	Level     int                     `json:"level"`
+	Regions   int                     `json:"regions"`
+	Options   LevelOptions            `json:"options"`
+	Countries map[string]LevelOptions `json:"countries,omitempty"` // countries with their own target
+}
+
+// Metadata is written to metadata.json next to the levels
+type Metadata struct {
+	Resolution int             `json:"resolution"`
+	Levels     []LevelMetadata `json:"levels"`
+}
+
+type QueueItem struct {
+	Region   RegionID
+	Priority float64
+}
+
 type LevelQueue struct {
-	Length  int
-	Regions []Region
+	Length int
+	Items  []QueueItem
 }
 
 func (q *LevelQueue) Len() int {
@@ -45,25 +235,25 @@ func (q *LevelQueue) Len() int {
 }
 
 func (q *LevelQueue) Less(i, j int) bool {
-	return q.Regions[i].Population > q.Regions[j].Population
+	return q.Items[i].Priority > q.Items[j].Priority
 }
 
 func (q *LevelQueue) Swap(i, j int) {
-	buffer := q.Regions[i]
-	q.Regions[i] = q.Regions[j]
-	q.Regions[j] = buffer
+	buffer := q.Items[i]
+	q.Items[i] = q.Items[j]
+	q.Items[j] = buffer
 }
 
 func (q *LevelQueue) Push(x any) {
-	q.Regions = append(q.Regions, x.(Region))
+	q.Items = append(q.Items, x.(QueueItem))
 	q.Length++
 }
 
 func (q *LevelQueue) Pop() any {
-	reg := q.Regions[q.Length-1]
-	q.Regions = q.Regions[:q.Length-1]
+	item := q.Items[q.Length-1]
+	q.Items = q.Items[:q.Length-1]
 	q.Length--
-	return reg
+	return item
 }
 
 var ResolutionSizes map[int]int = map[int]int{
@@ -117,35 +307,157 @@ func NewStaticStack[T any](size int) *StaticStack[T] {
 }
 
 type GeoJson struct {
-	Features []struct {
-		Properties struct {
-			Name string `json:"ADMIN"`
-		} `json:"properties"`
-		Geometry struct {
-			Type        string            `json:"type"`
-			Coordinates [][][]interface{} `json:"coordinates"`
-		} `json:"geometry"`
-	} `json:"features"`
+	Type     string           `json:"type"`
+	Features []GeoJsonFeature `json:"features"`
+}
+
+type GeoJsonFeature struct {
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   *GeoJsonGeometry       `json:"geometry"` // null for features without a location
+}
+
+// GeoJsonGeometry keeps coordinates raw since how deeply they nest depends
+// on Type. GeometryCollections have Geometries instead.
+type GeoJsonGeometry struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometries  []GeoJsonGeometry `json:"geometries"`
 }
 
 type CountryPolygons map[string][]h3.GeoPolygon
-type H3ToCountry map[string]string
-type CountryToH3 map[string][]string
 
-type Level map[string]Region
+// CountryNames maps country codes, the keys of every country map, to display names
+type CountryNames map[string]string
+
+// ContestedTile is a tile the polygons of several countries cover
+type ContestedTile struct {
+	Tile      string   `json:"tile"`
+	Claimants []string `json:"claimants"` // country codes, sorted
+	Country   string   `json:"country"`   // who got it
+}
+
+// CountryEntry is a country in countryToH3.json
+type CountryEntry struct {
+	Name  string   `json:"name"`
+	Tiles []string `json:"tiles"`
+}
+
+// H3ToAdmin maps tiles to the admin-1 area (state, province) they are in
+type H3ToAdmin map[h3.H3Index]string
+
+// H3ToCountry is keyed by h3 index in memory and by h3 string in json
+type H3ToCountry map[h3.H3Index]string
+
+func (m H3ToCountry) MarshalJSON() ([]byte, error) {
+	out := make(map[string]string, len(m))
+	for h, country := range m {
+		out[h3.ToString(h)] = country
+	}
+	return json.Marshal(out)
+}
+
+func (m *H3ToCountry) UnmarshalJSON(data []byte) error {
+	in := map[string]string{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if *m == nil {
+		*m = make(H3ToCountry, len(in))
+	}
+	// every tile of a country shares one copy of its name
+	names := map[string]string{}
+	for tile, country := range in {
+		name, ok := names[country]
+		if !ok {
+			names[country] = country
+			name = country
+		}
+		(*m)[h3.FromString(tile)] = name
+	}
+	return nil
+}
+
+// CountryToH3 stores tiles as h3 indexes in memory and h3 strings in json
+type CountryToH3 map[string][]h3.H3Index
+
+func (m CountryToH3) MarshalJSON() ([]byte, error) {
+	out := make(map[string][]string, len(m))
+	for country, tiles := range m {
+		out[country] = H3Strings(tiles)
+	}
+	return json.Marshal(out)
+}
+
+func (m *CountryToH3) UnmarshalJSON(data []byte) error {
+	in := map[string][]string{}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if *m == nil {
+		*m = make(CountryToH3, len(in))
+	}
+	for country, tiles := range in {
+		(*m)[country] = H3Indexes(tiles)
+	}
+	return nil
+}
 
-func LevelTotalTiles(level Level) int {
-	sum := 0
-	for _, region := range level {
-		sum += len(region.Tiles)
+func H3Strings(tiles []h3.H3Index) []string {
+	out := make([]string, len(tiles))
+	for i, tile := range tiles {
+		out[i] = h3.ToString(tile)
 	}
-	return sum
+	return out
 }
 
-func LevelTotalPop(level Level) float64 {
-	sum := 0.0
-	for _, region := range level {
-		sum += region.Population
+func H3Indexes(tiles []string) []h3.H3Index {
+	out := make([]h3.H3Index, len(tiles))
+	for i, tile := range tiles {
+		out[i] = h3.FromString(tile)
 	}
-	return sum
+	return out
+}
+
+// Lineage records how the regions of a level relate to the regions of the
+// same level in a previous generation.
+type Lineage struct {
+	Kept    []string            `json:"kept"`    // ids carried over from the previous generation
+	Created []string            `json:"created"` // ids that did not exist in the previous generation
+	Retired []string            `json:"retired"` // previous ids that no longer exist
+	Splits  map[string][]string `json:"splits"`  // previous id -> current ids it was divided between
+	Merges  map[string][]string `json:"merges"`  // current id -> previous ids it absorbed
+}
+
+// UnmetRegion is a region that is still below its level's minPopulation,
+// minRegionSize or a weight minimum after generation, and why it couldn't be
+// merged away.
+type UnmetRegion struct {
+	Region     string   `json:"region"`
+	Population float64  `json:"population"`
+	Weights    Weights  `json:"weights,omitempty"`
+	Tiles      int      `json:"tiles"`
+	Unmet      []string `json:"unmet"` // the constraints it breaks
+	Reason     string   `json:"reason"`
+}
+
+type RegionFeatureProperties struct {
+	Index      string      `json:"index"`
+	Population float64     `json:"population"`
+	Weights    Weights     `json:"weights,omitempty"`
+	Centroid   h3.GeoCoord `json:"centroid"`
+	Neighbors  []string    `json:"neighbors"`
+}
+
+type RegionFeature struct {
+	Type       string                  `json:"type"`
+	Properties RegionFeatureProperties `json:"properties"`
+	Geometry   struct {
+		Type        string           `json:"type"`
+		Coordinates [][][][2]float64 `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+type RegionFeatureCollection struct {
+	Type     string          `json:"type"`
+	Features []RegionFeature `json:"features"`
 }
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mappichat/regions-engine/src/utils"
+)
+
+const codeUnauthorized = "unauthorized"
+
+// AuthOptions configures jwt authentication. Auth is disabled when neither
+// JwksURL nor StaticSecret is set.
+type AuthOptions struct {
+	JwksURL         string
+	StaticSecret    string // HMAC secret used instead of a JWKS, for local testing
+	Audience        string
+	Issuer          string
+	RefreshInterval time.Duration
+}
+
+func (a AuthOptions) Enabled() bool {
+	return a.JwksURL != "" || a.StaticSecret != ""
+}
+
+func newKeyfunc(options AuthOptions) (jwt.Keyfunc, error) {
+	if options.StaticSecret != "" {
+		secret := []byte(options.StaticSecret)
+		return func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+			}
+			return secret, nil
+		}, nil
+	}
+	jwks, err := utils.JwksCreatePublicKey(options.JwksURL, options.RefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+	return jwks.Keyfunc, nil
+}
+
+// authMiddleware rejects requests without a valid bearer token
+func authMiddleware(options AuthOptions) (fiber.Handler, error) {
+	keyfunc, err := newKeyfunc(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *fiber.Ctx) error {
+		header := c.Get(fiber.HeaderAuthorization)
+		if !strings.HasPrefix(header, "Bearer ") {
+			return newApiError(fiber.StatusUnauthorized, codeUnauthorized, "missing bearer token")
+		}
+
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(strings.TrimPrefix(header, "Bearer "), claims, keyfunc)
+		if err != nil || !token.Valid {
+			if err == nil {
+				err = errors.New("token is invalid")
+			}
+			return newApiError(fiber.StatusUnauthorized, codeUnauthorized, "invalid token: %s", err.Error())
+		}
+		if options.Audience != "" && !claims.VerifyAudience(options.Audience, true) {
+			return newApiError(fiber.StatusUnauthorized, codeUnauthorized, "token audience does not match")
+		}
+		if options.Issuer != "" && !claims.VerifyIssuer(options.Issuer, true) {
+			return newApiError(fiber.StatusUnauthorized, codeUnauthorized, "token issuer does not match")
+		}
+
+		c.Locals("claims", claims)
+		return c.Next()
+	}, nil
+}
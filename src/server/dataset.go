@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mappichat/regions-engine/src/fileio"
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// Dataset is an immutable snapshot of a data directory. Requests hold on to
+// the snapshot they started with, so a reload never changes data under them.
+type Dataset struct {
+	Version         string
+	Resolution      int
+	Levels          []project_types.Level
+	TileRegions     map[h3.H3Index]project_types.RegionID // level 0 region of every tile
+	Up              [][]project_types.RegionID            // Up[i][id] is the level i+1 region containing level i region id
+	Edges           tileIndex                             // tiles on the edge of the generated area, for lookups outside it
+	H3ToCountry     project_types.H3ToCountry             // tile -> country code
+	CountryToH3     project_types.CountryToH3
+	CountryNames    project_types.CountryNames
+	Ocean           map[h3.H3Index]bool // tiles assigned by the ocean policy
+	CountryPolygons project_types.CountryPolygons
+}
+
+type ReloadOptions struct {
+	WatchInterval time.Duration // how often to check the data directory for changes; 0 disables watching
+	AdminToken    string        // required in the X-Admin-Token header of POST /reload; empty disables it
+}
+
+// DataVersion fingerprints the files in dataDir by name, size and modification
+// time so changes can be detected without reading them.
+func DataVersion(dataDir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
+	if err != nil {
+		return "", err
+	}
+	binaries, err := filepath.Glob(filepath.Join(dataDir, "*.bin"))
+	if err != nil {
+		return "", err
+	}
+	matches = append(matches, binaries...)
+	sort.Strings(matches)
+	hasher := fnv.New64a()
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hasher, "%s:%d:%d;", filepath.Base(match), info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%016x", hasher.Sum64()), nil
+}
+
+func LoadDataset(dataDir string) (*Dataset, error) {
+	version, err := DataVersion(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Print("reading country maps from json")
+	countryPolygons, countryToH3, h3ToCountry, countryNames, err := fileio.ReadCountryMaps(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	ocean, err := fileio.ReadOceanTiles(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	log.Print("reading levels")
+	levels, err := fileio.ReadLevels(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	tileRegions, up, err := indexLevels(levels)
+	if err != nil {
+		return nil, err
+	}
+
+	// every tile shares the dataset resolution
+	resolution := h3.Resolution(levels[0][0].Tiles[0])
+
+	return &Dataset{
+		Version:         version,
+		Resolution:      resolution,
+		Levels:          levels,
+		TileRegions:     tileRegions,
+		Up:              up,
+		Edges:           newTileIndex(tileRegions),
+		H3ToCountry:     h3ToCountry,
+		CountryToH3:     countryToH3,
+		CountryNames:    countryNames,
+		Ocean:           ocean,
+		CountryPolygons: countryPolygons,
+	}, nil
+}
+
+// datasetHolder swaps datasets atomically and makes sure only one reload
+// runs at a time
+type datasetHolder struct {
+	dataDir string
+	current atomic.Value
+	loading sync.Mutex
+}
+
+func (d *datasetHolder) Get() *Dataset {
+	return d.current.Load().(*Dataset)
+}
+
+// Reload loads the data directory and swaps it in if it's valid. It returns
+// false without doing anything if a reload is already running.
+func (d *datasetHolder) Reload() (bool, error) {
+	if !d.loading.TryLock() {
+		return false, nil
+	}
+	defer d.loading.Unlock()
+
+	start := time.Now()
+	log.Printf("reloading dataset from %s\n", d.dataDir)
+	dataset, err := LoadDataset(d.dataDir)
+	if err != nil {
+		log.Printf("reload failed, still serving %s: %s\n", d.Get().Version, err.Error())
+		return true, err
+	}
+	d.current.Store(dataset)
+	log.Printf("now serving dataset %s (loaded in %s)\n", dataset.Version, time.Since(start))
+	return true, nil
+}
+
+// watch reloads whenever the data directory changes. A change has to be
+// stable for a full interval so half written files aren't picked up.
+func (d *datasetHolder) watch(interval time.Duration) {
+	pending := ""
+	failed := ""
+	for range time.Tick(interval) {
+		version, err := DataVersion(d.dataDir)
+		if err != nil {
+			log.Printf("watching %s: %s\n", d.dataDir, err.Error())
+			continue
+		}
+		if version == d.Get().Version || version == failed {
+			pending = ""
+			continue
+		}
+		if version != pending {
+			pending = version
+			continue
+		}
+		if _, err := d.Reload(); err != nil {
+			failed = version
+		}
+		pending = ""
+	}
+}
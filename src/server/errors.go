@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+const (
+	maxRequestTiles = 1000
+	maxRingRadius   = 20
+)
+
+const (
+	codeMalformedBody   = "malformed_body"
+	codeInvalidRequest  = "invalid_request"
+	codeUnknownLevel    = "unknown_level"
+	codeUnknownTile     = "unknown_tile"
+	codeMalformedH3     = "malformed_h3_index"
+	codeTooManyTiles    = "too_many_tiles"
+	codeRadiusTooLarge  = "radius_too_large"
+	codeNotFound        = "not_found"
+	codeForbidden       = "forbidden"
+	codeInternal        = "internal_error"
+	codeDataUnavailable = "data_unavailable"
+)
+
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newApiError(status int, code string, format string, args ...any) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorHandler turns every error returned by a handler into a json body
+func errorHandler(c *fiber.Ctx, err error) error {
+	var apiErr *apiError
+	var fiberErr *fiber.Error
+	if !errors.As(err, &apiErr) {
+		if errors.As(err, &fiberErr) {
+			code := codeInvalidRequest
+			if fiberErr.Code == fiber.StatusNotFound {
+				code = codeNotFound
+			} else if fiberErr.Code >= fiber.StatusInternalServerError {
+				code = codeInternal
+			}
+			apiErr = &apiError{Status: fiberErr.Code, Code: code, Message: fiberErr.Message}
+		} else {
+			log.Print(err)
+			apiErr = &apiError{Status: fiber.StatusInternalServerError, Code: codeInternal, Message: "internal server error"}
+		}
+	}
+	return c.Status(apiErr.Status).JSON(fiber.Map{"error": apiErr})
+}
+
+func checkLevel(levels []project_types.Level, level int) error {
+	if level < 0 || level >= len(levels) {
+		return newApiError(fiber.StatusBadRequest, codeUnknownLevel, "level %d does not exist, levels are 0 to %d", level, len(levels)-1)
+	}
+	return nil
+}
+
+// checkTile makes sure tile is a well formed h3 index that was generated
+func checkTile(tileRegions map[h3.H3Index]project_types.RegionID, resolution int, tile string) (h3.H3Index, error) {
+	h := h3.FromString(tile)
+	if !h3.IsValid(h) {
+		return 0, newApiError(fiber.StatusBadRequest, codeMalformedH3, "%q is not a valid h3 index", tile)
+	}
+	if res := h3.Resolution(h); res != resolution {
+		return 0, newApiError(fiber.StatusBadRequest, codeUnknownTile, "%s has resolution %d but the dataset uses resolution %d", tile, res, resolution)
+	}
+	if _, ok := tileRegions[h]; !ok {
+		return 0, newApiError(fiber.StatusNotFound, codeUnknownTile, "%s is not part of any region", tile)
+	}
+	return h, nil
+}
+
+// indexLevels validates levels and links them together: it returns the level
+// 0 region of every tile, and for every level but the last, the region in the
+// level above that each region belongs to. Datasets that would otherwise panic
+// or silently return empty regions once requests come in are rejected.
+func indexLevels(levels []project_types.Level) (map[h3.H3Index]project_types.RegionID, [][]project_types.RegionID, error) {
+	if len(levels) == 0 {
+		return nil, nil, errors.New("no levels found")
+	}
+	for i, level := range levels {
+		if len(level) == 0 {
+			return nil, nil, fmt.Errorf("level %d has no regions", i)
+		}
+		for id, region := range level {
+			if id > 0 && level[id-1].Index >= region.Index {
+				return nil, nil, fmt.Errorf("level %d regions are not sorted by index", i)
+			}
+			if len(region.Tiles) == 0 {
+				return nil, nil, fmt.Errorf("level %d region %s has no tiles", i, h3.ToString(region.Index))
+			}
+			for _, neighbor := range region.Neighbors {
+				if neighbor < 0 || int(neighbor) >= len(level) {
+					return nil, nil, fmt.Errorf("level %d region %s has unknown neighbor %d", i, h3.ToString(region.Index), neighbor)
+				}
+			}
+		}
+	}
+
+	tileRegions := levels[0].TileParents()
+	totalTiles := len(tileRegions)
+	up := make([][]project_types.RegionID, len(levels)-1)
+	for i := 1; i < len(levels); i++ {
+		if tiles := project_types.LevelTotalTiles(levels[i]); tiles != totalTiles {
+			return nil, nil, fmt.Errorf("level %d has %d tiles but level 0 has %d", i, tiles, totalTiles)
+		}
+		up[i-1] = make([]project_types.RegionID, len(levels[i-1]))
+		assigned := make([]bool, len(levels[i-1]))
+		for id, region := range levels[i] {
+			for _, tile := range region.Tiles {
+				below, ok := tileRegions[tile]
+				if !ok {
+					return nil, nil, fmt.Errorf("level %d region %s has tile %s missing from level 0", i, h3.ToString(region.Index), h3.ToString(tile))
+				}
+				for j := 0; j < i-1; j++ {
+					below = up[j][below]
+				}
+				if assigned[below] && up[i-1][below] != project_types.RegionID(id) {
+					return nil, nil, fmt.Errorf("level %d region %s is split across level %d", i-1, h3.ToString(levels[i-1][below].Index), i)
+				}
+				up[i-1][below] = project_types.RegionID(id)
+				assigned[below] = true
+			}
+		}
+	}
+	return tileRegions, up, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"math"
+	"sort"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+type edgeTile struct {
+	tile  h3.H3Index
+	point [3]float64
+}
+
+// tileIndex finds the generated tile nearest to a point outside the generated
+// area. Only tiles on the edge of the area can be nearest to such a point, so
+// it holds just those, as a k-d tree over their centers on the unit sphere,
+// where straight line distance orders tiles the same as great circle distance.
+type tileIndex []edgeTile
+
+// unitPoint is where coord is on the unit sphere
+func unitPoint(coord h3.GeoCoord) [3]float64 {
+	lat, lng := coord.Latitude*math.Pi/180, coord.Longitude*math.Pi/180
+	return [3]float64{math.Cos(lat) * math.Cos(lng), math.Cos(lat) * math.Sin(lng), math.Sin(lat)}
+}
+
+func newTileIndex(tileRegions map[h3.H3Index]project_types.RegionID) tileIndex {
+	index := tileIndex{}
+	for tile := range tileRegions {
+		for _, neighbor := range h3.KRing(tile, 1) {
+			if _, ok := tileRegions[neighbor]; !ok {
+				index = append(index, edgeTile{tile: tile, point: unitPoint(h3.ToGeo(tile))})
+				break
+			}
+		}
+	}
+	// start from a fixed order so the tree doesn't depend on map iteration
+	sort.Slice(index, func(i, j int) bool { return index[i].tile < index[j].tile })
+	index.build(0, len(index), 0)
+	return index
+}
+
+// build arranges index[lo:hi] so its median on axis depth%3 is in the middle,
+// with the tiles below it before and the rest after, each half built the same
+// way on the next axis
+func (index tileIndex) build(lo int, hi int, depth int) {
+	if hi-lo < 2 {
+		return
+	}
+	axis := depth % 3
+	nodes := index[lo:hi]
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].point[axis] != nodes[j].point[axis] {
+			return nodes[i].point[axis] < nodes[j].point[axis]
+		}
+		return nodes[i].tile < nodes[j].tile
+	})
+	mid := (lo + hi) / 2
+	index.build(lo, mid, depth+1)
+	index.build(mid+1, hi, depth+1)
+}
+
+// nearest returns the edge tile whose center is closest to coord, 0 if there
+// are none
+func (index tileIndex) nearest(coord h3.GeoCoord) h3.H3Index {
+	target := unitPoint(coord)
+	best := h3.H3Index(0)
+	bestDist := math.MaxFloat64
+	var search func(lo int, hi int, depth int)
+	search = func(lo int, hi int, depth int) {
+		if lo >= hi {
+			return
+		}
+		mid := (lo + hi) / 2
+		node := index[mid]
+		dist := 0.0
+		for i := range target {
+			dist += (target[i] - node.point[i]) * (target[i] - node.point[i])
+		}
+		if dist < bestDist || (dist == bestDist && node.tile < best) {
+			best, bestDist = node.tile, dist
+		}
+		diff := target[depth%3] - node.point[depth%3]
+		if diff < 0 {
+			search(lo, mid, depth+1)
+			if diff*diff <= bestDist {
+				search(mid+1, hi, depth+1)
+			}
+		} else {
+			search(mid+1, hi, depth+1)
+			if diff*diff <= bestDist {
+				search(lo, mid, depth+1)
+			}
+		}
+	}
+	search(0, len(index), 0)
+	return best
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/mappichat/regions-engine/src/project_types"
+	"github.com/mappichat/regions-engine/src/utils"
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// coast is the western half of a disc of resolution 5 tiles, so its coastline
+// runs north to south along longitude 10
+func coast() map[h3.H3Index]project_types.RegionID {
+	tileRegions := map[h3.H3Index]project_types.RegionID{}
+	for _, tile := range h3.KRing(h3.FromGeo(h3.GeoCoord{Latitude: 10, Longitude: 10}, 5), 15) {
+		if h3.ToGeo(tile).Longitude < 10 {
+			tileRegions[tile] = 0
+		}
+	}
+	return tileRegions
+}
+
+func distanceTo(coord h3.GeoCoord, tile h3.H3Index) float64 {
+	center := h3.ToGeo(tile)
+	return utils.Distance(coord.Latitude, coord.Longitude, center.Latitude, center.Longitude)
+}
+
+func TestNearestTileOffCoast(t *testing.T) {
+	tileRegions := coast()
+	edges := newTileIndex(tileRegions)
+	if len(edges) == 0 || len(edges) >= len(tileRegions) {
+		t.Fatalf("%d of %d tiles are on the edge", len(edges), len(tileRegions))
+	}
+
+	random := rand.New(rand.NewSource(1))
+	coords := []h3.GeoCoord{{Latitude: 10, Longitude: 10.3}, {Latitude: 11, Longitude: 12}, {Latitude: 9.5, Longitude: 25}, {Latitude: -40, Longitude: -170}}
+	for i := 0; i < 200; i++ {
+		coords = append(coords, h3.GeoCoord{Latitude: 10 + random.Float64()*20 - 10, Longitude: 10 + random.Float64()*10})
+	}
+	for _, coord := range coords {
+		got, nearest := nearestTile(coord, 5, tileRegions, edges)
+		want, wantDist := h3.H3Index(0), math.MaxFloat64
+		for tile := range tileRegions {
+			if dist := distanceTo(coord, tile); dist < wantDist {
+				want, wantDist = tile, dist
+			}
+		}
+		if _, inside := tileRegions[h3.FromGeo(coord, 5)]; inside == nearest {
+			t.Errorf("%v is inside %v but nearest is %v", coord, inside, nearest)
+		}
+		if got == 0 || distanceTo(coord, got) > wantDist+1e-9 {
+			t.Errorf("nearest tile to %v is %s, %g away, want %s, %g away", coord, h3.ToString(got), distanceTo(coord, got), h3.ToString(want), wantDist)
+		}
+	}
+
+	if tile := newTileIndex(nil).nearest(coords[0]); tile != 0 {
+		t.Errorf("empty index returned %s", h3.ToString(tile))
+	}
+}
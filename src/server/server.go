@@ -3,50 +3,153 @@ package server
 import (
 	"fmt"
 	"log"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mappichat/regions-engine/src/project_types"
+	h3 "github.com/uber/h3-go/v3"
 )
 
 var validate = validator.New()
 
-func RunServer(
-	levels []map[string]project_types.Region,
-	parents []map[string]string,
-	h3ToCountry project_types.H3ToCountry,
-	countryToH3 project_types.CountryToH3,
-	countryPolygons project_types.CountryPolygons,
-	port int,
-) {
-	app := fiber.New()
+type lookupRegion struct {
+	Region     string                `json:"region"`
+	Population float64               `json:"population"`
+	Weights    project_types.Weights `json:"weights,omitempty"`
+	Centroid   h3.GeoCoord           `json:"centroid"`
+}
+
+// nearestTile returns the generated tile closest to coord and whether it had
+// to look beyond the tile containing coord.
+func nearestTile(coord h3.GeoCoord, resolution int, tileRegions map[h3.H3Index]project_types.RegionID, edges tileIndex) (h3.H3Index, bool) {
+	origin := h3.FromGeo(coord, resolution)
+	if _, ok := tileRegions[origin]; ok {
+		return origin, false
+	}
+	return edges.nearest(coord), true
+}
+
+// parseBody parses and validates a json request body into payload
+func parseBody(c *fiber.Ctx, payload any) error {
+	if err := c.BodyParser(payload); err != nil {
+		return newApiError(fiber.StatusBadRequest, codeMalformedBody, "could not parse request body: %s", err.Error())
+	}
+	if err := validate.Struct(payload); err != nil {
+		return newApiError(fiber.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+	return nil
+}
+
+// regionOf finds the region a validated tile belongs to
+func (ds *Dataset) regionOf(level int, tile h3.H3Index) project_types.RegionID {
+	id := ds.TileRegions[tile]
+	for i := 0; i < level; i++ {
+		id = ds.Up[i][id]
+	}
+	return id
+}
+
+// dataset returns the snapshot a request was started with
+func dataset(c *fiber.Ctx) *Dataset {
+	return c.Locals("dataset").(*Dataset)
+}
+
+func RunServer(dataDir string, port int, auth AuthOptions, reload ReloadOptions) {
+	initial, err := LoadDataset(dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	holder := &datasetHolder{dataDir: dataDir}
+	holder.current.Store(initial)
+	log.Printf("serving dataset %s\n", initial.Version)
+
+	if reload.WatchInterval > 0 {
+		log.Printf("watching %s for changes every %s\n", dataDir, reload.WatchInterval)
+		go holder.watch(reload.WatchInterval)
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+
+	// pin the current dataset for the lifetime of the request
+	app.Use(func(c *fiber.Ctx) error {
+		ds := holder.Get()
+		c.Locals("dataset", ds)
+		c.Set("X-Dataset-Version", ds.Version)
+		return c.Next()
+	})
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Healthy")
 	})
 
+	// everything registered after this requires a token
+	if auth.Enabled() {
+		middleware, err := authMiddleware(auth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Use(middleware)
+		log.Print("jwt authentication enabled")
+	}
+
+	app.Get("/version", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"version": dataset(c).Version})
+	})
+
+	app.Post("/reload", func(c *fiber.Ctx) error {
+		log.Printf("/reload: %s\n", time.Now())
+		if reload.AdminToken == "" {
+			return newApiError(fiber.StatusForbidden, codeForbidden, "reloading is disabled, start the server with an admin token to enable it")
+		}
+		if c.Get("X-Admin-Token") != reload.AdminToken {
+			return newApiError(fiber.StatusForbidden, codeForbidden, "reloading requires a valid X-Admin-Token header")
+		}
+		go holder.Reload()
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"status":  "reloading",
+			"version": dataset(c).Version,
+		})
+	})
+
 	app.Post("/regions", func(c *fiber.Ctx) error {
 		log.Printf("/regions: %s\n", time.Now())
+		ds := dataset(c)
 		payload := struct {
 			Tiles  []string `json:"tiles" validate:"required"`
 			Levels []int    `json:"levels" validate:"required"`
 		}{}
 
-		if err := c.BodyParser(&payload); err != nil {
+		if err := parseBody(c, &payload); err != nil {
 			return err
 		}
-		if err := validate.Struct(payload); err != nil {
-			return err
+		if len(payload.Tiles) > maxRequestTiles {
+			return newApiError(fiber.StatusBadRequest, codeTooManyTiles, "at most %d tiles can be requested at once, got %d", maxRequestTiles, len(payload.Tiles))
+		}
+		for _, level := range payload.Levels {
+			if err := checkLevel(ds.Levels, level); err != nil {
+				return err
+			}
+		}
+		tiles := make([]h3.H3Index, len(payload.Tiles))
+		for i, tile := range payload.Tiles {
+			h, err := checkTile(ds.TileRegions, ds.Resolution, tile)
+			if err != nil {
+				return err
+			}
+			tiles[i] = h
 		}
 
 		regions := map[int]map[string][]string{}
 
 		for _, level := range payload.Levels {
 			regions[level] = map[string][]string{}
-			for _, tile := range payload.Tiles {
-				parent := parents[level][tile]
-				regions[level][parent] = levels[level][parent].Tiles
+			for _, tile := range tiles {
+				region := ds.Levels[level][ds.regionOf(level, tile)]
+				regions[level][h3.ToString(region.Index)] = project_types.H3Strings(region.Tiles)
 			}
 		}
 
@@ -55,32 +158,41 @@ func RunServer(
 
 	app.Post("/ring", func(c *fiber.Ctx) error {
 		log.Printf("/ring: %s\n", time.Now())
+		ds := dataset(c)
 		payload := struct {
 			Tile   string `json:"tile" validate:"required"`
 			Level  int    `json:"level"`
 			Radius int    `json:"radius"`
 		}{}
 
-		if err := c.BodyParser(&payload); err != nil {
+		if err := parseBody(c, &payload); err != nil {
 			return err
 		}
-		if err := validate.Struct(payload); err != nil {
+		if err := checkLevel(ds.Levels, payload.Level); err != nil {
+			return err
+		}
+		if payload.Radius < 0 || payload.Radius > maxRingRadius {
+			return newApiError(fiber.StatusBadRequest, codeRadiusTooLarge, "radius must be between 0 and %d, got %d", maxRingRadius, payload.Radius)
+		}
+		tile, err := checkTile(ds.TileRegions, ds.Resolution, payload.Tile)
+		if err != nil {
 			return err
 		}
 
 		regions := map[string][]string{}
 
-		center := parents[payload.Level][payload.Tile]
+		level := ds.Levels[payload.Level]
+		center := ds.regionOf(payload.Level, tile)
 		r := 0
 		i := 0
-		regionQueue := []string{center}
-		seen := map[string]bool{center: true}
+		regionQueue := []project_types.RegionID{center}
+		seen := map[project_types.RegionID]bool{center: true}
 		for r <= payload.Radius {
 			nextEnd := len(regionQueue)
 			for i < nextEnd {
 				current := regionQueue[i]
-				regions[current] = levels[payload.Level][current].Tiles
-				for neighbor := range levels[payload.Level][current].Neighbors {
+				regions[h3.ToString(level[current].Index)] = project_types.H3Strings(level[current].Tiles)
+				for _, neighbor := range level[current].Neighbors {
 					if _, ok := seen[neighbor]; !ok {
 						regionQueue = append(regionQueue, neighbor)
 						seen[neighbor] = true
@@ -98,21 +210,88 @@ func RunServer(
 
 	app.Post("/country", func(c *fiber.Ctx) error {
 		log.Printf("/country: %s\n", time.Now())
+		ds := dataset(c)
 		payload := struct {
 			Tile string `json:"tile" validate:"required"`
 		}{}
 
-		if err := c.BodyParser(&payload); err != nil {
+		if err := parseBody(c, &payload); err != nil {
 			return err
 		}
-		if err := validate.Struct(payload); err != nil {
-			return err
+		country, ok := ds.H3ToCountry[h3.FromString(payload.Tile)]
+		if !ok {
+			if _, err := checkTile(ds.TileRegions, ds.Resolution, payload.Tile); err != nil {
+				return err
+			}
+			return newApiError(fiber.StatusNotFound, codeUnknownTile, "%s is not part of any country", payload.Tile)
 		}
 		log.Print(payload.Tile)
-		country := h3ToCountry[payload.Tile]
 		log.Print(country)
 
-		return c.JSON(countryToH3[h3ToCountry[payload.Tile]])
+		return c.JSON(project_types.H3Strings(ds.CountryToH3[country]))
+	})
+
+	app.Get("/lookup", func(c *fiber.Ctx) error {
+		log.Printf("/lookup: %s\n", time.Now())
+		ds := dataset(c)
+		lat, err := strconv.ParseFloat(c.Query("lat"), 64)
+		if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+			return newApiError(fiber.StatusBadRequest, codeInvalidRequest, "lat must be a number between -90 and 90")
+		}
+		lng, err := strconv.ParseFloat(c.Query("lng"), 64)
+		if err != nil || math.IsNaN(lng) || lng < -180 || lng > 180 {
+			return newApiError(fiber.StatusBadRequest, codeInvalidRequest, "lng must be a number between -180 and 180")
+		}
+		requested := []int{}
+		if c.Query("levels") == "" {
+			for i := range ds.Levels {
+				requested = append(requested, i)
+			}
+		} else {
+			for _, s := range strings.Split(c.Query("levels"), ",") {
+				level, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil {
+					return newApiError(fiber.StatusBadRequest, codeInvalidRequest, "levels must be comma separated integers")
+				}
+				if err := checkLevel(ds.Levels, level); err != nil {
+					return err
+				}
+				requested = append(requested, level)
+			}
+		}
+
+		coord := h3.GeoCoord{Latitude: lat, Longitude: lng}
+		tile, nearest := nearestTile(coord, ds.Resolution, ds.TileRegions, ds.Edges)
+		if tile == 0 {
+			return newApiError(fiber.StatusNotFound, codeUnknownTile, "no region near %g, %g", lat, lng)
+		}
+
+		response := struct {
+			Tile        string               `json:"tile"`
+			Nearest     bool                 `json:"nearest"`
+			Country     string               `json:"country"`
+			CountryName string               `json:"countryName"`
+			Ocean       bool                 `json:"ocean"`
+			Levels      map[int]lookupRegion `json:"levels"`
+		}{
+			Tile:        h3.ToString(tile),
+			Nearest:     nearest,
+			Country:     ds.H3ToCountry[tile],
+			CountryName: ds.CountryNames[ds.H3ToCountry[tile]],
+			Ocean:       ds.Ocean[tile],
+			Levels:      map[int]lookupRegion{},
+		}
+		for _, level := range requested {
+			region := ds.Levels[level][ds.regionOf(level, tile)]
+			response.Levels[level] = lookupRegion{
+				Region:     h3.ToString(region.Index),
+				Population: region.Population,
+				Weights:    region.Weights,
+				Centroid:   region.Centroid,
+			}
+		}
+
+		return c.JSON(response)
 	})
 
 	log.Fatal(app.Listen(fmt.Sprintf(":%d", port)))
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/iancoleman/strcase"
 	"github.com/mappichat/regions-engine/src/project_types"
@@ -31,10 +32,10 @@ func DecodeSnakeCase(input interface{}) (map[string]interface{}, error) {
 }
 
 func WriteAsJsonFile(v interface{}, filePath string) error {
-	base := path.Base(filePath)
-	dirPath := filePath[:len(filePath)-len(base)]
-	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-		return err
+	if dirPath := filepath.Dir(filePath); dirPath != "." {
+		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+			return err
+		}
 	}
 
 	log.Print("marshalling json")
@@ -59,31 +60,30 @@ func FileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func ReadJsonFile(filePath string, dest interface{}) error {
-	var bytes = []byte{}
-	var err error
+// ReadFileBytes reads a local file, or fetches it if filePath is a url
+func ReadFileBytes(filePath string) ([]byte, error) {
 	if FileExists(filePath) {
-		bytes, err = os.ReadFile(path.Join(filePath))
-		if err != nil {
-			return err
-		}
-	} else {
-		url, err := url.ParseRequestURI(filePath)
-		if err != nil {
-			return err
-		}
-		resp, err := http.Get(url.String())
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("unexpected http GET status: %s", resp.Status)
-		}
-		bytes, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
+		return os.ReadFile(path.Join(filePath))
+	}
+	url, err := url.ParseRequestURI(filePath)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(url.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http GET status: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func ReadJsonFile(filePath string, dest interface{}) error {
+	bytes, err := ReadFileBytes(filePath)
+	if err != nil {
+		return err
 	}
 
 	if err = json.Unmarshal(bytes, &dest); err != nil {
@@ -92,13 +92,13 @@ func ReadJsonFile(filePath string, dest interface{}) error {
 	return nil
 }
 
-func H3Slice(resolution int) []string {
+func H3Slice(resolution int) []h3.H3Index {
 	size, ok := project_types.ResolutionSizes[resolution]
 	if !ok {
 		panic(errors.New("invalid resolution"))
 	}
 
-	slice := make([]string, size)
+	slice := make([]h3.H3Index, size)
 	i := 0
 	for h := range H3Tiles(resolution) {
 		slice[i] = h
@@ -107,22 +107,22 @@ func H3Slice(resolution int) []string {
 	return slice
 }
 
-func H3Tiles(resolution int) chan string {
+func H3Tiles(resolution int) chan h3.H3Index {
 	size, ok := project_types.ResolutionSizes[resolution]
 	if !ok {
 		panic(errors.New("invalid resolution"))
 	}
 
-	ch := make(chan string)
+	ch := make(chan h3.H3Index)
 
-	start := h3.ToString(h3.FromGeo(h3.GeoCoord{
+	start := h3.FromGeo(h3.GeoCoord{
 		Latitude:  0,
 		Longitude: 0,
-	}, int(resolution)))
+	}, int(resolution))
 
-	seen := make(map[string]bool, size)
+	seen := make(map[h3.H3Index]bool, size)
 	seen[start] = true
-	stack := project_types.NewStaticStack[string](size)
+	stack := project_types.NewStaticStack[h3.H3Index](size)
 	if err := stack.Push(start); err != nil {
 		panic(err)
 	}
@@ -134,15 +134,13 @@ func H3Tiles(resolution int) chan string {
 				continue
 			}
 			ch <- *h
-			for _, tile := range h3.KRing(h3.FromString(*h), 1) {
-				tileString := h3.ToString(tile)
-
-				if _, in := seen[tileString]; !in {
-					err = stack.Push(tileString)
+			for _, tile := range h3.KRing(*h, 1) {
+				if _, in := seen[tile]; !in {
+					err = stack.Push(tile)
 					if err != nil {
 						panic(err)
 					}
-					seen[tileString] = true
+					seen[tile] = true
 				}
 			}
 		}
@@ -151,17 +149,16 @@ func H3Tiles(resolution int) chan string {
 	return ch
 }
 
-func H3BorderTiles(tiles []string) []string {
-	border := []string{}
-	seen := map[string]bool{}
+func H3BorderTiles(tiles []h3.H3Index) []h3.H3Index {
+	border := []h3.H3Index{}
+	seen := map[h3.H3Index]bool{}
 	for _, tile := range tiles {
 		seen[tile] = true
 	}
 	for _, tile := range tiles {
-		for _, h := range h3.KRing(h3.FromString(tile), 1) {
-			curr := h3.ToString(h)
-			if _, ok := seen[curr]; !ok {
-				border = append(border, curr)
+		for _, h := range h3.KRing(tile, 1) {
+			if _, ok := seen[h]; !ok {
+				border = append(border, h)
 				continue
 			}
 		}
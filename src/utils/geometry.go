@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"math"
+	"sort"
+
+	h3 "github.com/uber/h3-go/v3"
+)
+
+// vertices are snapped to roughly a centimeter so neighboring cells agree on
+// shared corners
+const vertexPrecision = 1e7
+
+type vertexKey struct {
+	lat int64
+	lng int64
+}
+
+func (k vertexKey) less(other vertexKey) bool {
+	if k.lat != other.lat {
+		return k.lat < other.lat
+	}
+	return k.lng < other.lng
+}
+
+func keyOf(coord h3.GeoCoord) vertexKey {
+	return vertexKey{
+		lat: int64(math.Round(coord.Latitude * vertexPrecision)),
+		lng: int64(math.Round(coord.Longitude * vertexPrecision)),
+	}
+}
+
+// H3SetToPolygons dissolves a set of tiles into polygons. Each polygon is a
+// list of closed rings where the first ring is the outer boundary
+// (counter-clockwise) and the rest are holes (clockwise).
+func H3SetToPolygons(tiles []h3.H3Index) [][][]h3.GeoCoord {
+	inSet := make(map[h3.H3Index]bool, len(tiles))
+	for _, tile := range tiles {
+		inSet[tile] = true
+	}
+
+	// every edge between a tile in the set and one outside of it is part of
+	// the outline. edges are directed counter-clockwise around their tile so
+	// they chain together into rings.
+	next := map[vertexKey][]h3.GeoCoord{}
+	for h := range inSet {
+		for _, edge := range h3.ToUnidirectionalEdges(h) {
+			if inSet[h3.DestinationFromUnidirectionalEdge(edge)] {
+				continue
+			}
+			vertices := h3.UnidirectionalEdgeBoundary(edge)
+			if len(vertices) < 2 {
+				continue
+			}
+			next[keyOf(vertices[0])] = vertices
+		}
+	}
+
+	// every ring starts at its smallest vertex and rings are traced from the
+	// smallest start on, so outer rings, and the holes of every polygon, come
+	// out sorted by their first vertex and the same set always gives the same
+	// polygons
+	starts := make([]vertexKey, 0, len(next))
+	for k := range next {
+		starts = append(starts, k)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].less(starts[j]) })
+
+	outer := [][]h3.GeoCoord{}
+	holes := [][]h3.GeoCoord{}
+	for _, start := range starts {
+		if _, ok := next[start]; !ok {
+			continue
+		}
+		ring := []h3.GeoCoord{}
+		current := start
+		for {
+			vertices, ok := next[current]
+			if !ok {
+				break
+			}
+			delete(next, current)
+			ring = append(ring, vertices[:len(vertices)-1]...)
+			current = keyOf(vertices[len(vertices)-1])
+			if current == start {
+				break
+			}
+		}
+		if len(ring) < 3 {
+			continue
+		}
+		ring = append(ring, ring[0])
+		// rings crossing the antimeridian keep going past ±180 so their area
+		// and what they contain come out right
+		if unwrapped, aroundPole := unwrapRing(ring); !aroundPole {
+			if min, max := lngRange(unwrapped); min < -180 || max > 180 {
+				ring = unwrapped
+			}
+		}
+		if ringArea(ring) >= 0 {
+			outer = append(outer, ring)
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+
+	polygons := make([][][]h3.GeoCoord, len(outer))
+	for i := range outer {
+		polygons[i] = [][]h3.GeoCoord{outer[i]}
+	}
+	for _, hole := range holes {
+		// holes belong to the smallest outer ring that contains them
+		best := -1
+		bestArea := math.MaxFloat64
+		for i := range outer {
+			area := ringArea(outer[i])
+			if area < bestArea && RingContains(outer[i], nearestCopy(hole[0], outer[i])) {
+				best = i
+				bestArea = area
+			}
+		}
+		if best >= 0 {
+			polygons[best] = append(polygons[best], hole)
+		}
+	}
+
+	// rings that went past ±180 are cut back into range
+	split := make([][][]h3.GeoCoord, 0, len(polygons))
+	for _, rings := range polygons {
+		if min, max := lngRange(rings[0]); min >= -180 && max <= 180 {
+			split = append(split, rings)
+			continue
+		}
+		for _, polygon := range SplitAntimeridian(rings) {
+			part := [][]h3.GeoCoord{closeRing(polygon.Geofence)}
+			for _, hole := range polygon.Holes {
+				part = append(part, closeRing(hole))
+			}
+			split = append(split, part)
+		}
+	}
+	return split
+}
+
+// nearestCopy moves point by whole turns of longitude to the copy of it
+// closest to ring
+func nearestCopy(point h3.GeoCoord, ring []h3.GeoCoord) h3.GeoCoord {
+	min, max := lngRange(ring)
+	point.Longitude += 360 * math.Round(((min+max)/2-point.Longitude)/360)
+	return point
+}
+
+func closeRing(ring []h3.GeoCoord) []h3.GeoCoord {
+	if len(ring) > 0 && keyOf(ring[0]) != keyOf(ring[len(ring)-1]) {
+		ring = append(ring, ring[0])
+	}
+	return ring
+}
+
+// signed area in degrees, positive when the ring is counter-clockwise
+func ringArea(ring []h3.GeoCoord) float64 {
+	area := 0.0
+	for i := 0; i < len(ring)-1; i++ {
+		area += ring[i].Longitude*ring[i+1].Latitude - ring[i+1].Longitude*ring[i].Latitude
+	}
+	return area / 2
+}
+
+// RingContains reports whether point is inside ring, counting the edges a ray
+// towards increasing longitude crosses
+func RingContains(ring []h3.GeoCoord, point h3.GeoCoord) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Latitude > point.Latitude) != (b.Latitude > point.Latitude) &&
+			point.Longitude < (b.Longitude-a.Longitude)*(point.Latitude-a.Latitude)/(b.Latitude-a.Latitude)+a.Longitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// LngDelta is the shortest longitude step from a to b
+func LngDelta(a float64, b float64) float64 {
+	delta := math.Mod(b-a, 360)
+	if delta > 180 {
+		delta -= 360
+	} else if delta <= -180 {
+		delta += 360
+	}
+	return delta
+}
+
+// unwrapRing makes longitudes continuous, so a ring crossing the antimeridian
+// goes past ±180 instead of jumping to the other side. It also reports
+// whether the ring goes all the way around a pole.
+func unwrapRing(ring []h3.GeoCoord) ([]h3.GeoCoord, bool) {
+	unwrapped := make([]h3.GeoCoord, len(ring))
+	unwrapped[0] = ring[0]
+	for i := 1; i < len(ring); i++ {
+		unwrapped[i] = h3.GeoCoord{
+			Latitude:  ring[i].Latitude,
+			Longitude: unwrapped[i-1].Longitude + LngDelta(ring[i-1].Longitude, ring[i].Longitude),
+		}
+	}
+	last := unwrapped[len(ring)-1].Longitude + LngDelta(ring[len(ring)-1].Longitude, ring[0].Longitude)
+	return unwrapped, math.Abs(last-unwrapped[0].Longitude) > 180
+}
+
+func lngRange(ring []h3.GeoCoord) (float64, float64) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, coord := range ring {
+		min = math.Min(min, coord.Longitude)
+		max = math.Max(max, coord.Longitude)
+	}
+	return min, max
+}
+
+// SplitAntimeridian cuts a polygon crossing the antimeridian into the parts
+// on either side, since h3.Polyfill and geojson viewers can't handle it. Rings around a pole
+// can't be cut like this and are left as they are.
+func SplitAntimeridian(rings [][]h3.GeoCoord) []h3.GeoPolygon {
+	whole := []h3.GeoPolygon{{Geofence: rings[0], Holes: rings[1:]}}
+	outer, aroundPole := unwrapRing(rings[0])
+	if aroundPole {
+		return whole
+	}
+	min, max := lngRange(outer)
+	if min >= -180 && max <= 180 {
+		return whole
+	}
+
+	// holes are unwrapped on the same side of the antimeridian as the outer ring
+	center := (min + max) / 2
+	holes := make([][]h3.GeoCoord, 0, len(rings)-1)
+	for _, ring := range rings[1:] {
+		hole, _ := unwrapRing(ring)
+		holeMin, holeMax := lngRange(hole)
+		shift := 360 * math.Round((center-(holeMin+holeMax)/2)/360)
+		for i := range hole {
+			hole[i].Longitude += shift
+		}
+		holes = append(holes, hole)
+	}
+
+	polygons := []h3.GeoPolygon{}
+	for k := math.Floor((min + 180) / 360); 360*k-180 < max; k++ {
+		low, high := 360*k-180, 360*k+180
+		fence := clipRing(outer, low, high, -360*k)
+		if len(fence) < 3 {
+			continue
+		}
+		polygon := h3.GeoPolygon{Geofence: fence, Holes: [][]h3.GeoCoord{}}
+		for _, hole := range holes {
+			if clipped := clipRing(hole, low, high, -360*k); len(clipped) >= 3 {
+				polygon.Holes = append(polygon.Holes, clipped)
+			}
+		}
+		polygons = append(polygons, polygon)
+	}
+	return polygons
+}
+
+// clipRing keeps the part of ring between longitudes low and high
+// (Sutherland-Hodgman) and moves it by shift degrees of longitude
+func clipRing(ring []h3.GeoCoord, low float64, high float64, shift float64) []h3.GeoCoord {
+	clipped := clipRingSide(ring, low, func(lng float64) bool { return lng >= low })
+	clipped = clipRingSide(clipped, high, func(lng float64) bool { return lng <= high })
+	for i := range clipped {
+		clipped[i].Longitude += shift
+	}
+	return clipped
+}
+
+func clipRingSide(ring []h3.GeoCoord, edge float64, inside func(float64) bool) []h3.GeoCoord {
+	out := []h3.GeoCoord{}
+	for i, current := range ring {
+		prev := ring[(i+len(ring)-1)%len(ring)]
+		if inside(current.Longitude) {
+			if !inside(prev.Longitude) {
+				out = append(out, crossing(prev, current, edge))
+			}
+			out = append(out, current)
+		} else if inside(prev.Longitude) {
+			out = append(out, crossing(prev, current, edge))
+		}
+	}
+	return out
+}
+
+// crossing is where the edge from a to b meets longitude lng
+func crossing(a h3.GeoCoord, b h3.GeoCoord, lng float64) h3.GeoCoord {
+	t := (lng - a.Longitude) / (b.Longitude - a.Longitude)
+	return h3.GeoCoord{Latitude: a.Latitude + t*(b.Latitude-a.Latitude), Longitude: lng}
+}
@@ -8,12 +8,15 @@ import (
 )
 
 func JwksCreatePublicKey(jwksURL string, refreshInterval time.Duration) (*keyfunc.JWKS, error) {
-	// Create the keyfunc options. Refresh the JWKS every hour and log errors.
+	// Create the keyfunc options. Refresh the JWKS on the given interval and log errors.
+	// A failed refresh keeps the previously fetched keys, so it shouldn't take the server down.
 	options := keyfunc.Options{
 		RefreshInterval: refreshInterval,
 		RefreshErrorHandler: func(err error) {
-			log.Fatalf("There was an error with the jwt.KeyFunc\nError: %s", err.Error())
+			log.Printf("There was an error refreshing the jwt.KeyFunc, keeping previous keys\nError: %s", err.Error())
 		},
+		RefreshUnknownKID: true,
+		RefreshRateLimit:  time.Minute,
 	}
 
 	// Create the JWKS from the resource at the given URL.